@@ -3,7 +3,6 @@ package main
 import (
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -13,17 +12,25 @@ import (
 	"github.com/valyala/fasthttp"
 
 	"github.com/ip-api/proxy/internal/batch"
+	"github.com/ip-api/proxy/internal/budget"
 	"github.com/ip-api/proxy/internal/cache"
+	"github.com/ip-api/proxy/internal/config"
 	"github.com/ip-api/proxy/internal/fetcher"
 	"github.com/ip-api/proxy/internal/handlers"
+	"github.com/ip-api/proxy/internal/ratelimit"
+	"github.com/ip-api/proxy/internal/resolve"
 	"github.com/ip-api/proxy/internal/reverse"
+	"github.com/ip-api/proxy/internal/tenant"
+	"github.com/ip-api/proxy/internal/trace"
 	"github.com/ip-api/proxy/internal/util"
 )
 
 func main() {
+	cfg, cfgErr := config.Load()
+
 	var logger zerolog.Logger
 
-	if os.Getenv("LOG_OUTPUT") == "console" {
+	if cfg.LogOutput == "console" {
 		logger = zerolog.New(zerolog.ConsoleWriter{
 			Out:        os.Stderr,
 			TimeFormat: "15:04:05.000",
@@ -50,43 +57,64 @@ func main() {
 		logger = logger.Hook(zerolog.HookFunc(defaultLevelToInfo))
 	}
 
-	// Default is to log everything.
-	switch os.Getenv("LOG_LEVEL") {
-	case "info":
-		logger = logger.Level(zerolog.InfoLevel)
-	case "warn":
-		logger = logger.Level(zerolog.WarnLevel)
-	case "error":
-		logger = logger.Level(zerolog.ErrorLevel)
-	}
+	zerolog.SetGlobalLevel(logLevel(cfg.LogLevel))
 
 	logger = logger.With().Str("part", "main").Logger()
 
-	reverser := reverse.New(logger.With().Str("part", "reverser").Logger())
+	if cfgErr != nil {
+		logger.Fatal().Err(cfgErr).Msg("invalid config")
+	}
+
+	tracer := trace.New(logger.With().Str("part", "trace").Logger(), cfg)
+	trace.Default = tracer
 
-	client, err := fetcher.NewIPApi(logger.With().Str("part", "fetcher").Logger(), reverser)
+	reverser := reverse.New(logger.With().Str("part", "reverser").Logger(), cfg)
+
+	spend, err := budget.New(logger.With().Str("part", "budget").Logger(), cfg)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("could not create fetcher")
+		logger.Fatal().Err(err).Msg("could not load budget")
 	}
 
-	cacheSize := 1024 * 1024 * 1024 // 1GB
-	if v := os.Getenv("CACHE_SIZE"); v != "" {
-		if n, err := strconv.Atoi(v); err != nil {
-			logger.Fatal().Err(err).Msg("invalid CACHE_SIZE")
-		} else {
-			cacheSize = n
-		}
+	client, err := newClient(logger.With().Str("part", "fetcher").Logger(), reverser, cfg, spend)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("could not create fetcher")
 	}
 
-	cache := cache.New(cacheSize)
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	cacheFile := cfg.CacheFile
+	cacheSaveInterval := cfg.CacheSaveInterval
+
+	c := cache.New(cfg.CacheSize)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), c, client, cfg)
+
+	if cacheFile != "" {
+		loadCache(logger, batches, cacheFile)
+
+		go func() {
+			for {
+				time.Sleep(cacheSaveInterval)
+				saveCache(logger, batches, cacheFile)
+			}
+		}()
+	}
 
 	go batches.ProcessLoop()
 
+	var tenants *tenant.Tenants
+	if cfg.TenantsFile != "" {
+		if tenants, err = tenant.Load(cfg.TenantsFile); err != nil {
+			logger.Fatal().Err(err).Msg("invalid TENANTS_FILE")
+		}
+	}
+
 	h := handlers.Handler{
-		Logger:  logger.With().Str("part", "handler").Logger(),
-		Batches: batches,
-		Client:  client,
+		Logger:         logger.With().Str("part", "handler").Logger(),
+		Batches:        batches,
+		Client:         client,
+		TrustedProxies: cfg.TrustedProxies,
+		Resolver:       resolve.New(logger.With().Str("part", "resolver").Logger(), cfg),
+		Tenants:        tenants,
+		Limiter:        ratelimit.New(cfg),
+		Budget:         spend,
 	}
 
 	s := &fasthttp.Server{
@@ -102,10 +130,7 @@ func main() {
 		NoDefaultContentType:  true,
 	}
 
-	addr := os.Getenv("LISTEN")
-	if addr == "" {
-		addr = "127.0.0.1:8080"
-	}
+	addr := cfg.Listen
 
 	logger.Info().Msgf("listening on %q", addr)
 
@@ -115,20 +140,172 @@ func main() {
 		}
 	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func(current config.Config) {
+		for range hup {
+			current = reloadConfig(logger, current, client, batches, spend)
+
+			if tenants != nil {
+				if err := tenants.Reload(current.TenantsFile); err != nil {
+					logger.Error().Err(err).Msg("failed to reload tenants, keeping the current tenants")
+				} else {
+					logger.Info().Msg("reloaded tenants")
+				}
+			}
+		}
+	}(cfg)
+
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	<-ch
 	signal.Stop(ch)
 
-	// Shut down the http server so another process can take over.
-	// But wait for 10 seconds to give active connections some time to terminate gracefully.
+	shutdown(logger, s, batches, tracer, cacheFile, cfg.ShutdownTimeout)
+
+	if err := spend.Save(); err != nil {
+		logger.Error().Err(err).Msg("failed to save budget")
+	}
+}
+
+// shutdown stops accepting connections so another process can take over, then gives active requests
+// and batches until timeout to finish before the traces and the cache are persisted.
+func shutdown(logger zerolog.Logger, s *fasthttp.Server, batches *batch.Batches, tracer *trace.Tracer, cacheFile string, timeout time.Duration) {
+	start := time.Now()
+	deadline := start.Add(timeout)
+
+	logger.Info().Dur("timeout", timeout).Msg("shutting down, no longer accepting connections")
+
+	// Shutdown closes the listeners right away, then waits for active connections to become idle.
+	serverDone := make(chan struct{})
 	go func() {
 		if err := s.Shutdown(); err != nil {
 			logger.Error().Err(err).Msg("failed to shutdown server")
 		}
+		close(serverDone)
 	}()
 
-	time.Sleep(time.Second * 10)
+	if running := batches.Drain(deadline); running > 0 {
+		logger.Warn().Int("batches", running).Msg("gave up waiting for running batches")
+	} else {
+		logger.Info().Dur("took", time.Since(start)).Msg("drained batches")
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	select {
+	case <-serverDone:
+		logger.Info().Dur("took", time.Since(start)).Msg("closed connections")
+	case <-timer.C:
+		logger.Warn().Msg("gave up waiting for active connections")
+	}
+	timer.Stop()
+
+	if !tracer.Flush(deadline) {
+		logger.Warn().Msg("gave up exporting spans")
+	}
+
+	if cacheFile != "" {
+		saveCache(logger, batches, cacheFile)
+	}
+
+	logger.Info().Dur("took", time.Since(start)).Msg("shutdown complete")
+}
+
+// newClient returns the fetcher for BACKEND, which is one of:
+//
+//	ip-api:      only use ip-api.com (default)
+//	mmdb:        only use the local databases in MMDB_FILE
+//	ip-api+mmdb: use ip-api.com and fall back on MMDB_FILE when it fails
+func newClient(logger zerolog.Logger, reverser reverse.Reverser, cfg config.Config, spend *budget.Budget) (fetcher.Client, error) {
+	switch cfg.Backend {
+	case "mmdb":
+		return fetcher.NewMMDB(logger, reverser, cfg)
+	case "ip-api+mmdb":
+		primary, err := fetcher.NewIPApi(logger, reverser, cfg, spend)
+		if err != nil {
+			return nil, err
+		}
+		secondary, err := fetcher.NewMMDB(logger, reverser, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return fetcher.NewFallback(logger, primary, secondary, cfg)
+	default:
+		return fetcher.NewIPApi(logger, reverser, cfg, spend)
+	}
+}
+
+// reloadConfig loads the config again and applies the settings that can change live.
+// It returns the config that is in use now: current with the new live settings.
+// The config isn't changed at all if the new one is invalid.
+func reloadConfig(logger zerolog.Logger, current config.Config, client fetcher.Client, batches *batch.Batches, spend *budget.Budget) config.Config {
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to reload config, keeping the current config")
+		return current
+	}
+
+	live, restart := current.Changes(cfg)
+	if len(restart) > 0 {
+		logger.Warn().Strs("settings", restart).Msg("changed settings require a restart")
+	}
+	if len(live) == 0 {
+		logger.Info().Msg("reloaded config, nothing to apply")
+		return current
+	}
+
+	client.Reload(cfg)
+	batches.Reload(cfg)
+	spend.Reload(cfg)
+	zerolog.SetGlobalLevel(logLevel(cfg.LogLevel))
+
+	logger.Info().Strs("settings", live).Msg("reloaded config")
+
+	return current.WithLive(cfg)
+}
+
+// logLevel returns the zerolog.Level for LOG_LEVEL. Default is to log everything.
+func logLevel(level string) zerolog.Level {
+	switch level {
+	case "info":
+		return zerolog.InfoLevel
+	case "warn":
+		return zerolog.WarnLevel
+	case "error":
+		return zerolog.ErrorLevel
+	default:
+		return zerolog.DebugLevel
+	}
+}
+
+// loadCache restores the cache from a snapshot written by saveCache.
+// A missing or corrupt snapshot is logged and otherwise ignored.
+func loadCache(logger zerolog.Logger, batches *batch.Batches, path string) {
+	entries, err := cache.ReadSnapshot(path, batches.MaxStale())
+	if os.IsNotExist(err) {
+		logger.Info().Str("file", path).Msg("no cache file to restore")
+		return
+	} else if err != nil {
+		logger.Error().Err(err).Str("file", path).Msg("failed to restore cache, starting empty")
+		return
+	}
+
+	batches.Restore(entries)
+
+	logger.Info().Str("file", path).Int("entries", len(entries)).Msg("restored cache")
+}
+
+// saveCache writes a snapshot of the cache to path.
+func saveCache(logger zerolog.Logger, batches *batch.Batches, path string) {
+	start := time.Now()
+	entries := batches.Snapshot()
+
+	if err := cache.WriteSnapshot(path, entries); err != nil {
+		logger.Error().Err(err).Str("file", path).Msg("failed to save cache")
+		return
+	}
+
+	logger.Info().Str("file", path).Int("entries", len(entries)).Dur("took", time.Since(start)).Msg("saved cache")
 }
 
 // convertLevelToStackdriver converts a zerolog.Level to a stackdriver compatible
@@ -1,8 +1,15 @@
 package main_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,10 +21,15 @@ import (
 
 	"github.com/ip-api/proxy/internal/batch"
 	"github.com/ip-api/proxy/internal/cache"
+	"github.com/ip-api/proxy/internal/config"
 	"github.com/ip-api/proxy/internal/fetcher"
 	"github.com/ip-api/proxy/internal/field"
 	"github.com/ip-api/proxy/internal/handlers"
+	"github.com/ip-api/proxy/internal/ratelimit"
+	"github.com/ip-api/proxy/internal/resolve"
 	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/tenant"
+	"github.com/ip-api/proxy/internal/trace"
 	"github.com/ip-api/proxy/internal/util"
 )
 
@@ -28,7 +40,7 @@ func TestSingle(t *testing.T) {
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	go batches.ProcessLoop()
 
@@ -65,7 +77,7 @@ func TestBatch(t *testing.T) {
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	go batches.ProcessLoop()
 
@@ -121,7 +133,7 @@ func TestBatchDefaults(t *testing.T) {
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	go batches.ProcessLoop()
 
@@ -157,7 +169,7 @@ func TestBatchBig(t *testing.T) {
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	go batches.ProcessLoop()
 
@@ -208,7 +220,8 @@ func TestBatchBig(t *testing.T) {
 	}
 
 	body := string(ctx.Response.Body())
-	expectedBody := `[{"country":"Some Country","city":"Some City"},{"country":"Some other Country","city":"Some other City"},{"country":"3.3.3.3en","city":"3.3.3.3en"},{"country":"4.4.4.4en","city":"4.4.4.4en"},{"country":"5.5.5.5en","city":"5.5.5.5en"},{"country":"6.6.6.6en","city":"6.6.6.6en"},{"country":"7.7.7.7en","city":"7.7.7.7en"},{"country":"8.8.8.8en","city":"8.8.8.8en"},{"country":"9.9.9.9en","city":"9.9.9.9en"},{"country":"10.10.10.10en","city":"10.10.10.10en"},{"country":"11.11.11.11en","city":"11.11.11.11en"},{"country":"12.12.12.12en","city":"12.12.12.12en"},{"country":"13.13.13.13en","city":"13.13.13.13en"},{"country":"14.14.14.14en","city":"14.14.14.14en"},{"country":"15.15.15.15en","city":"15.15.15.15en"},{"country":"16.16.16.16en","city":"16.16.16.16en"},{"country":"17.17.17.17en","city":"17.17.17.17en"},{"country":"18.18.18.18en","city":"18.18.18.18en"},{"country":"19.19.19.19en","city":"19.19.19.19en"},{"country":"20.20.20.20en","city":"20.20.20.20en"},{"country":"21.21.21.21en","city":"21.21.21.21en"},{"country":"22.22.22.22en","city":"22.22.22.22en"},{"country":"23.23.23.23en","city":"23.23.23.23en"},{"country":"24.24.24.24en","city":"24.24.24.24en"},{"country":"25.25.25.25en","city":"25.25.25.25en"},{"country":"26.26.26.26en","city":"26.26.26.26en"},{"country":"27.27.27.27en","city":"27.27.27.27en"},{"country":"28.28.28.28en","city":"28.28.28.28en"},{"country":"29.29.29.29en","city":"29.29.29.29en"},{"country":"30.30.30.30en","city":"30.30.30.30en"},{"country":"31.31.31.31en","city":"31.31.31.31en"},{"country":"32.32.32.32en","city":"32.32.32.32en"},{"country":"33.33.33.33en","city":"33.33.33.33en"},{"country":"34.34.34.34en","city":"34.34.34.34en"},{"country":"35.35.35.35en","city":"35.35.35.35en"},{"country":"36.36.36.36en","city":"36.36.36.36en"},{"country":"37.37.37.37en","city":"37.37.37.37en"},{"country":"38.38.38.38en","city":"38.38.38.38en"},{"country":"39.39.39.39en","city":"39.39.39.39en"},{"country":"40.40.40.40en","city":"40.40.40.40en"},{"country":"41.41.41.41en","city":"41.41.41.41en"},{"country":"42.42.42.42en","city":"42.42.42.42en"},{"country":"43.43.43.43en","city":"43.43.43.43en"},{"country":"44.44.44.44en","city":"44.44.44.44en"},{"country":"45.45.45.45en","city":"45.45.45.45en"},{"country":"46.46.46.46en","city":"46.46.46.46en"},{"country":"47.47.47.47en","city":"47.47.47.47en"},{"country":"48.48.48.48en","city":"48.48.48.48en"},{"country":"49.49.49.49en","city":"49.49.49.49en"},{"country":"50.50.50.50en","city":"50.50.50.50en"},{"country":"51.51.51.51en","city":"51.51.51.51en"},{"country":"52.52.52.52en","city":"52.52.52.52en"},{"country":"53.53.53.53en","city":"53.53.53.53en"},{"country":"54.54.54.54en","city":"54.54.54.54en"},{"country":"55.55.55.55en","city":"55.55.55.55en"},{"country":"56.56.56.56en","city":"56.56.56.56en"},{"country":"57.57.57.57en","city":"57.57.57.57en"},{"country":"58.58.58.58en","city":"58.58.58.58en"},{"country":"59.59.59.59en","city":"59.59.59.59en"},{"country":"60.60.60.60en","city":"60.60.60.60en"},{"country":"61.61.61.61en","city":"61.61.61.61en"},{"country":"62.62.62.62en","city":"62.62.62.62en"},{"country":"63.63.63.63en","city":"63.63.63.63en"},{"country":"64.64.64.64en","city":"64.64.64.64en"},{"country":"65.65.65.65en","city":"65.65.65.65en"},{"country":"66.66.66.66en","city":"66.66.66.66en"},{"country":"67.67.67.67en","city":"67.67.67.67en"},{"country":"68.68.68.68en","city":"68.68.68.68en"},{"country":"69.69.69.69en","city":"69.69.69.69en"},{"country":"70.70.70.70en","city":"70.70.70.70en"},{"country":"71.71.71.71en","city":"71.71.71.71en"},{"country":"72.72.72.72en","city":"72.72.72.72en"},{"country":"73.73.73.73en","city":"73.73.73.73en"},{"country":"74.74.74.74en","city":"74.74.74.74en"},{"country":"75.75.75.75en","city":"75.75.75.75en"},{"country":"76.76.76.76en","city":"76.76.76.76en"},{"country":"77.77.77.77en","city":"77.77.77.77en"},{"country":"78.78.78.78en","city":"78.78.78.78en"},{"country":"79.79.79.79en","city":"79.79.79.79en"},{"country":"80.80.80.80en","city":"80.80.80.80en"},{"country":"81.81.81.81en","city":"81.81.81.81en"},{"country":"82.82.82.82en","city":"82.82.82.82en"},{"country":"83.83.83.83en","city":"83.83.83.83en"},{"country":"84.84.84.84en","city":"84.84.84.84en"},{"country":"85.85.85.85en","city":"85.85.85.85en"},{"country":"86.86.86.86en","city":"86.86.86.86en"},{"country":"87.87.87.87en","city":"87.87.87.87en"},{"country":"88.88.88.88en","city":"88.88.88.88en"},{"country":"89.89.89.89en","city":"89.89.89.89en"},{"country":"90.90.90.90en","city":"90.90.90.90en"},{"country":"91.91.91.91en","city":"91.91.91.91en"},{"country":"92.92.92.92en","city":"92.92.92.92en"},{"country":"93.93.93.93en","city":"93.93.93.93en"},{"country":"94.94.94.94en","city":"94.94.94.94en"},{"country":"95.95.95.95en","city":"95.95.95.95en"},{"country":"96.96.96.96en","city":"96.96.96.96en"},{"country":"97.97.97.97en","city":"97.97.97.97en"},{"country":"98.98.98.98en","city":"98.98.98.98en"},{"country":"99.99.99.99en","city":"99.99.99.99en"},{"country":"100.100.100.100en","city":"100.100.100.100en"},{"country":"101.101.101.101en","city":"101.101.101.101en"},{"country":"102.102.102.102en","city":"102.102.102.102en"},{"country":"103.103.103.103en","city":"103.103.103.103en"},{"country":"104.104.104.104en","city":"104.104.104.104en"},{"country":"105.105.105.105en","city":"105.105.105.105en"},{"country":"106.106.106.106en","city":"106.106.106.106en"},{"country":"107.107.107.107en","city":"107.107.107.107en"},{"country":"108.108.108.108en","city":"108.108.108.108en"},{"country":"109.109.109.109en","city":"109.109.109.109en"},{"country":"110.110.110.110en","city":"110.110.110.110en"},{"country":"111.111.111.111en","city":"111.111.111.111en"},{"country":"112.112.112.112en","city":"112.112.112.112en"},{"country":"113.113.113.113en","city":"113.113.113.113en"},{"country":"114.114.114.114en","city":"114.114.114.114en"},{"country":"115.115.115.115en","city":"115.115.115.115en"},{"country":"116.116.116.116en","city":"116.116.116.116en"},{"country":"117.117.117.117en","city":"117.117.117.117en"},{"country":"118.118.118.118en","city":"118.118.118.118en"},{"country":"119.119.119.119en","city":"119.119.119.119en"},{"country":"120.120.120.120en","city":"120.120.120.120en"},{"country":"121.121.121.121en","city":"121.121.121.121en"},{"country":"122.122.122.122en","city":"122.122.122.122en"},{"country":"123.123.123.123en","city":"123.123.123.123en"},{"country":"124.124.124.124en","city":"124.124.124.124en"},{"country":"125.125.125.125en","city":"125.125.125.125en"},{"country":"126.126.126.126en","city":"126.126.126.126en"},{"country":"127.127.127.127en","city":"127.127.127.127en"},{"country":"128.128.128.128en","city":"128.128.128.128en"},{"country":"129.129.129.129en","city":"129.129.129.129en"},{"country":"130.130.130.130en","city":"130.130.130.130en"},{"country":"131.131.131.131en","city":"131.131.131.131en"},{"country":"132.132.132.132en","city":"132.132.132.132en"},{"country":"133.133.133.133en","city":"133.133.133.133en"},{"country":"134.134.134.134en","city":"134.134.134.134en"},{"country":"135.135.135.135en","city":"135.135.135.135en"},{"country":"136.136.136.136en","city":"136.136.136.136en"},{"country":"137.137.137.137en","city":"137.137.137.137en"},{"country":"138.138.138.138en","city":"138.138.138.138en"},{"country":"139.139.139.139en","city":"139.139.139.139en"},{"country":"140.140.140.140en","city":"140.140.140.140en"},{"country":"141.141.141.141en","city":"141.141.141.141en"},{"country":"142.142.142.142en","city":"142.142.142.142en"},{"country":"143.143.143.143en","city":"143.143.143.143en"},{"country":"144.144.144.144en","city":"144.144.144.144en"},{"country":"145.145.145.145en","city":"145.145.145.145en"},{"country":"146.146.146.146en","city":"146.146.146.146en"},{"country":"147.147.147.147en","city":"147.147.147.147en"},{"country":"148.148.148.148en","city":"148.148.148.148en"},{"country":"149.149.149.149en","city":"149.149.149.149en"},{"country":"150.150.150.150en","city":"150.150.150.150en"}]`
+	// 10.10.10.10, 100.100.100.100 and 127.127.127.127 are answered by the proxy itself and have no country or city.
+	expectedBody := `[{"country":"Some Country","city":"Some City"},{"country":"Some other Country","city":"Some other City"},{"country":"3.3.3.3en","city":"3.3.3.3en"},{"country":"4.4.4.4en","city":"4.4.4.4en"},{"country":"5.5.5.5en","city":"5.5.5.5en"},{"country":"6.6.6.6en","city":"6.6.6.6en"},{"country":"7.7.7.7en","city":"7.7.7.7en"},{"country":"8.8.8.8en","city":"8.8.8.8en"},{"country":"9.9.9.9en","city":"9.9.9.9en"},{},{"country":"11.11.11.11en","city":"11.11.11.11en"},{"country":"12.12.12.12en","city":"12.12.12.12en"},{"country":"13.13.13.13en","city":"13.13.13.13en"},{"country":"14.14.14.14en","city":"14.14.14.14en"},{"country":"15.15.15.15en","city":"15.15.15.15en"},{"country":"16.16.16.16en","city":"16.16.16.16en"},{"country":"17.17.17.17en","city":"17.17.17.17en"},{"country":"18.18.18.18en","city":"18.18.18.18en"},{"country":"19.19.19.19en","city":"19.19.19.19en"},{"country":"20.20.20.20en","city":"20.20.20.20en"},{"country":"21.21.21.21en","city":"21.21.21.21en"},{"country":"22.22.22.22en","city":"22.22.22.22en"},{"country":"23.23.23.23en","city":"23.23.23.23en"},{"country":"24.24.24.24en","city":"24.24.24.24en"},{"country":"25.25.25.25en","city":"25.25.25.25en"},{"country":"26.26.26.26en","city":"26.26.26.26en"},{"country":"27.27.27.27en","city":"27.27.27.27en"},{"country":"28.28.28.28en","city":"28.28.28.28en"},{"country":"29.29.29.29en","city":"29.29.29.29en"},{"country":"30.30.30.30en","city":"30.30.30.30en"},{"country":"31.31.31.31en","city":"31.31.31.31en"},{"country":"32.32.32.32en","city":"32.32.32.32en"},{"country":"33.33.33.33en","city":"33.33.33.33en"},{"country":"34.34.34.34en","city":"34.34.34.34en"},{"country":"35.35.35.35en","city":"35.35.35.35en"},{"country":"36.36.36.36en","city":"36.36.36.36en"},{"country":"37.37.37.37en","city":"37.37.37.37en"},{"country":"38.38.38.38en","city":"38.38.38.38en"},{"country":"39.39.39.39en","city":"39.39.39.39en"},{"country":"40.40.40.40en","city":"40.40.40.40en"},{"country":"41.41.41.41en","city":"41.41.41.41en"},{"country":"42.42.42.42en","city":"42.42.42.42en"},{"country":"43.43.43.43en","city":"43.43.43.43en"},{"country":"44.44.44.44en","city":"44.44.44.44en"},{"country":"45.45.45.45en","city":"45.45.45.45en"},{"country":"46.46.46.46en","city":"46.46.46.46en"},{"country":"47.47.47.47en","city":"47.47.47.47en"},{"country":"48.48.48.48en","city":"48.48.48.48en"},{"country":"49.49.49.49en","city":"49.49.49.49en"},{"country":"50.50.50.50en","city":"50.50.50.50en"},{"country":"51.51.51.51en","city":"51.51.51.51en"},{"country":"52.52.52.52en","city":"52.52.52.52en"},{"country":"53.53.53.53en","city":"53.53.53.53en"},{"country":"54.54.54.54en","city":"54.54.54.54en"},{"country":"55.55.55.55en","city":"55.55.55.55en"},{"country":"56.56.56.56en","city":"56.56.56.56en"},{"country":"57.57.57.57en","city":"57.57.57.57en"},{"country":"58.58.58.58en","city":"58.58.58.58en"},{"country":"59.59.59.59en","city":"59.59.59.59en"},{"country":"60.60.60.60en","city":"60.60.60.60en"},{"country":"61.61.61.61en","city":"61.61.61.61en"},{"country":"62.62.62.62en","city":"62.62.62.62en"},{"country":"63.63.63.63en","city":"63.63.63.63en"},{"country":"64.64.64.64en","city":"64.64.64.64en"},{"country":"65.65.65.65en","city":"65.65.65.65en"},{"country":"66.66.66.66en","city":"66.66.66.66en"},{"country":"67.67.67.67en","city":"67.67.67.67en"},{"country":"68.68.68.68en","city":"68.68.68.68en"},{"country":"69.69.69.69en","city":"69.69.69.69en"},{"country":"70.70.70.70en","city":"70.70.70.70en"},{"country":"71.71.71.71en","city":"71.71.71.71en"},{"country":"72.72.72.72en","city":"72.72.72.72en"},{"country":"73.73.73.73en","city":"73.73.73.73en"},{"country":"74.74.74.74en","city":"74.74.74.74en"},{"country":"75.75.75.75en","city":"75.75.75.75en"},{"country":"76.76.76.76en","city":"76.76.76.76en"},{"country":"77.77.77.77en","city":"77.77.77.77en"},{"country":"78.78.78.78en","city":"78.78.78.78en"},{"country":"79.79.79.79en","city":"79.79.79.79en"},{"country":"80.80.80.80en","city":"80.80.80.80en"},{"country":"81.81.81.81en","city":"81.81.81.81en"},{"country":"82.82.82.82en","city":"82.82.82.82en"},{"country":"83.83.83.83en","city":"83.83.83.83en"},{"country":"84.84.84.84en","city":"84.84.84.84en"},{"country":"85.85.85.85en","city":"85.85.85.85en"},{"country":"86.86.86.86en","city":"86.86.86.86en"},{"country":"87.87.87.87en","city":"87.87.87.87en"},{"country":"88.88.88.88en","city":"88.88.88.88en"},{"country":"89.89.89.89en","city":"89.89.89.89en"},{"country":"90.90.90.90en","city":"90.90.90.90en"},{"country":"91.91.91.91en","city":"91.91.91.91en"},{"country":"92.92.92.92en","city":"92.92.92.92en"},{"country":"93.93.93.93en","city":"93.93.93.93en"},{"country":"94.94.94.94en","city":"94.94.94.94en"},{"country":"95.95.95.95en","city":"95.95.95.95en"},{"country":"96.96.96.96en","city":"96.96.96.96en"},{"country":"97.97.97.97en","city":"97.97.97.97en"},{"country":"98.98.98.98en","city":"98.98.98.98en"},{"country":"99.99.99.99en","city":"99.99.99.99en"},{},{"country":"101.101.101.101en","city":"101.101.101.101en"},{"country":"102.102.102.102en","city":"102.102.102.102en"},{"country":"103.103.103.103en","city":"103.103.103.103en"},{"country":"104.104.104.104en","city":"104.104.104.104en"},{"country":"105.105.105.105en","city":"105.105.105.105en"},{"country":"106.106.106.106en","city":"106.106.106.106en"},{"country":"107.107.107.107en","city":"107.107.107.107en"},{"country":"108.108.108.108en","city":"108.108.108.108en"},{"country":"109.109.109.109en","city":"109.109.109.109en"},{"country":"110.110.110.110en","city":"110.110.110.110en"},{"country":"111.111.111.111en","city":"111.111.111.111en"},{"country":"112.112.112.112en","city":"112.112.112.112en"},{"country":"113.113.113.113en","city":"113.113.113.113en"},{"country":"114.114.114.114en","city":"114.114.114.114en"},{"country":"115.115.115.115en","city":"115.115.115.115en"},{"country":"116.116.116.116en","city":"116.116.116.116en"},{"country":"117.117.117.117en","city":"117.117.117.117en"},{"country":"118.118.118.118en","city":"118.118.118.118en"},{"country":"119.119.119.119en","city":"119.119.119.119en"},{"country":"120.120.120.120en","city":"120.120.120.120en"},{"country":"121.121.121.121en","city":"121.121.121.121en"},{"country":"122.122.122.122en","city":"122.122.122.122en"},{"country":"123.123.123.123en","city":"123.123.123.123en"},{"country":"124.124.124.124en","city":"124.124.124.124en"},{"country":"125.125.125.125en","city":"125.125.125.125en"},{"country":"126.126.126.126en","city":"126.126.126.126en"},{},{"country":"128.128.128.128en","city":"128.128.128.128en"},{"country":"129.129.129.129en","city":"129.129.129.129en"},{"country":"130.130.130.130en","city":"130.130.130.130en"},{"country":"131.131.131.131en","city":"131.131.131.131en"},{"country":"132.132.132.132en","city":"132.132.132.132en"},{"country":"133.133.133.133en","city":"133.133.133.133en"},{"country":"134.134.134.134en","city":"134.134.134.134en"},{"country":"135.135.135.135en","city":"135.135.135.135en"},{"country":"136.136.136.136en","city":"136.136.136.136en"},{"country":"137.137.137.137en","city":"137.137.137.137en"},{"country":"138.138.138.138en","city":"138.138.138.138en"},{"country":"139.139.139.139en","city":"139.139.139.139en"},{"country":"140.140.140.140en","city":"140.140.140.140en"},{"country":"141.141.141.141en","city":"141.141.141.141en"},{"country":"142.142.142.142en","city":"142.142.142.142en"},{"country":"143.143.143.143en","city":"143.143.143.143en"},{"country":"144.144.144.144en","city":"144.144.144.144en"},{"country":"145.145.145.145en","city":"145.145.145.145en"},{"country":"146.146.146.146en","city":"146.146.146.146en"},{"country":"147.147.147.147en","city":"147.147.147.147en"},{"country":"148.148.148.148en","city":"148.148.148.148en"},{"country":"149.149.149.149en","city":"149.149.149.149en"},{"country":"150.150.150.150en","city":"150.150.150.150en"}]`
 	if body != expectedBody {
 		t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
 	}
@@ -223,7 +236,7 @@ func TestBatchPartialFail(t *testing.T) {
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	h := handlers.Handler{
 		Logger:  logger.With().Str("part", "handler").Logger(),
@@ -242,7 +255,7 @@ func TestBatchPartialFail(t *testing.T) {
 				"query": "asdasd",
 				"fields": "status,message"
 			},
-			"0.0.0.0","1.1.1.1","2.2.2.2","3.3.3.3","4.4.4.4","5.5.5.5","6.6.6.6","7.7.7.7","8.8.8.8","9.9.9.9",
+			"1.2.3.4","1.1.1.1","2.2.2.2","3.3.3.3","4.4.4.4","5.5.5.5","6.6.6.6","7.7.7.7","8.8.8.8","9.9.9.9",
 			"10.10.10.10","11.11.11.11","12.12.12.12","13.13.13.13","14.14.14.14","15.15.15.15","16.16.16.16","17.17.17.17",
 			"18.18.18.18","19.19.19.19","20.20.20.20","21.21.21.21","22.22.22.22","23.23.23.23","24.24.24.24","25.25.25.25",
 			"26.26.26.26","27.27.27.27","28.28.28.28","29.29.29.29","30.30.30.30","31.31.31.31","32.32.32.32","33.33.33.33",
@@ -282,8 +295,10 @@ func TestBatchPartialFail(t *testing.T) {
 
 	body := string(ctx.Response.Body())
 	// The first IP fails and isn't even added to the batch.
-	// The 100 after that fail because they are added to a batch and contain 0.0.0.0en.
-	expectedBody := `[{"status":"fail","message":"invalid query"},` + strings.Repeat(`{"status":"fail"},`, 100) + `{"status":"","country":"100.100.100.100en","city":"100.100.100.100en"},{"status":"","country":"101.101.101.101en","city":"101.101.101.101en"},{"status":"","country":"102.102.102.102en","city":"102.102.102.102en"},{"status":"","country":"103.103.103.103en","city":"103.103.103.103en"},{"status":"","country":"104.104.104.104en","city":"104.104.104.104en"},{"status":"","country":"105.105.105.105en","city":"105.105.105.105en"},{"status":"","country":"106.106.106.106en","city":"106.106.106.106en"},{"status":"","country":"107.107.107.107en","city":"107.107.107.107en"},{"status":"","country":"108.108.108.108en","city":"108.108.108.108en"},{"status":"","country":"109.109.109.109en","city":"109.109.109.109en"},{"status":"","country":"110.110.110.110en","city":"110.110.110.110en"},{"status":"","country":"111.111.111.111en","city":"111.111.111.111en"},{"status":"","country":"112.112.112.112en","city":"112.112.112.112en"},{"status":"","country":"113.113.113.113en","city":"113.113.113.113en"},{"status":"","country":"114.114.114.114en","city":"114.114.114.114en"},{"status":"","country":"115.115.115.115en","city":"115.115.115.115en"},{"status":"","country":"116.116.116.116en","city":"116.116.116.116en"},{"status":"","country":"117.117.117.117en","city":"117.117.117.117en"},{"status":"","country":"118.118.118.118en","city":"118.118.118.118en"},{"status":"","country":"119.119.119.119en","city":"119.119.119.119en"},{"status":"","country":"120.120.120.120en","city":"120.120.120.120en"},{"status":"","country":"121.121.121.121en","city":"121.121.121.121en"},{"status":"","country":"122.122.122.122en","city":"122.122.122.122en"},{"status":"","country":"123.123.123.123en","city":"123.123.123.123en"},{"status":"","country":"124.124.124.124en","city":"124.124.124.124en"},{"status":"","country":"125.125.125.125en","city":"125.125.125.125en"},{"status":"","country":"126.126.126.126en","city":"126.126.126.126en"},{"status":"","country":"127.127.127.127en","city":"127.127.127.127en"},{"status":"","country":"128.128.128.128en","city":"128.128.128.128en"},{"status":"","country":"129.129.129.129en","city":"129.129.129.129en"},{"status":"","country":"130.130.130.130en","city":"130.130.130.130en"},{"status":"","country":"131.131.131.131en","city":"131.131.131.131en"},{"status":"","country":"132.132.132.132en","city":"132.132.132.132en"},{"status":"","country":"133.133.133.133en","city":"133.133.133.133en"},{"status":"","country":"134.134.134.134en","city":"134.134.134.134en"},{"status":"","country":"135.135.135.135en","city":"135.135.135.135en"},{"status":"","country":"136.136.136.136en","city":"136.136.136.136en"},{"status":"","country":"137.137.137.137en","city":"137.137.137.137en"},{"status":"","country":"138.138.138.138en","city":"138.138.138.138en"},{"status":"","country":"139.139.139.139en","city":"139.139.139.139en"},{"status":"","country":"140.140.140.140en","city":"140.140.140.140en"},{"status":"","country":"141.141.141.141en","city":"141.141.141.141en"},{"status":"","country":"142.142.142.142en","city":"142.142.142.142en"},{"status":"","country":"143.143.143.143en","city":"143.143.143.143en"},{"status":"","country":"144.144.144.144en","city":"144.144.144.144en"},{"status":"","country":"145.145.145.145en","city":"145.145.145.145en"},{"status":"","country":"146.146.146.146en","city":"146.146.146.146en"},{"status":"","country":"147.147.147.147en","city":"147.147.147.147en"},{"status":"","country":"148.148.148.148en","city":"148.148.148.148en"}]`
+	// The 100 after that fail because they are added to a batch and contain 1.2.3.4en.
+	// 10.10.10.10, 100.100.100.100 and 127.127.127.127 fail because they are private or reserved,
+	// they aren't added to the batch so 101.101.101.101 is part of the first batch as well.
+	expectedBody := `[{"status":"fail","message":"invalid query"},` + strings.Repeat(`{"status":"fail"},`, 100) + `{"status":"fail"},{"status":"fail"},{"status":"","country":"102.102.102.102en","city":"102.102.102.102en"},{"status":"","country":"103.103.103.103en","city":"103.103.103.103en"},{"status":"","country":"104.104.104.104en","city":"104.104.104.104en"},{"status":"","country":"105.105.105.105en","city":"105.105.105.105en"},{"status":"","country":"106.106.106.106en","city":"106.106.106.106en"},{"status":"","country":"107.107.107.107en","city":"107.107.107.107en"},{"status":"","country":"108.108.108.108en","city":"108.108.108.108en"},{"status":"","country":"109.109.109.109en","city":"109.109.109.109en"},{"status":"","country":"110.110.110.110en","city":"110.110.110.110en"},{"status":"","country":"111.111.111.111en","city":"111.111.111.111en"},{"status":"","country":"112.112.112.112en","city":"112.112.112.112en"},{"status":"","country":"113.113.113.113en","city":"113.113.113.113en"},{"status":"","country":"114.114.114.114en","city":"114.114.114.114en"},{"status":"","country":"115.115.115.115en","city":"115.115.115.115en"},{"status":"","country":"116.116.116.116en","city":"116.116.116.116en"},{"status":"","country":"117.117.117.117en","city":"117.117.117.117en"},{"status":"","country":"118.118.118.118en","city":"118.118.118.118en"},{"status":"","country":"119.119.119.119en","city":"119.119.119.119en"},{"status":"","country":"120.120.120.120en","city":"120.120.120.120en"},{"status":"","country":"121.121.121.121en","city":"121.121.121.121en"},{"status":"","country":"122.122.122.122en","city":"122.122.122.122en"},{"status":"","country":"123.123.123.123en","city":"123.123.123.123en"},{"status":"","country":"124.124.124.124en","city":"124.124.124.124en"},{"status":"","country":"125.125.125.125en","city":"125.125.125.125en"},{"status":"","country":"126.126.126.126en","city":"126.126.126.126en"},{"status":"fail"},{"status":"","country":"128.128.128.128en","city":"128.128.128.128en"},{"status":"","country":"129.129.129.129en","city":"129.129.129.129en"},{"status":"","country":"130.130.130.130en","city":"130.130.130.130en"},{"status":"","country":"131.131.131.131en","city":"131.131.131.131en"},{"status":"","country":"132.132.132.132en","city":"132.132.132.132en"},{"status":"","country":"133.133.133.133en","city":"133.133.133.133en"},{"status":"","country":"134.134.134.134en","city":"134.134.134.134en"},{"status":"","country":"135.135.135.135en","city":"135.135.135.135en"},{"status":"","country":"136.136.136.136en","city":"136.136.136.136en"},{"status":"","country":"137.137.137.137en","city":"137.137.137.137en"},{"status":"","country":"138.138.138.138en","city":"138.138.138.138en"},{"status":"","country":"139.139.139.139en","city":"139.139.139.139en"},{"status":"","country":"140.140.140.140en","city":"140.140.140.140en"},{"status":"","country":"141.141.141.141en","city":"141.141.141.141en"},{"status":"","country":"142.142.142.142en","city":"142.142.142.142en"},{"status":"","country":"143.143.143.143en","city":"143.143.143.143en"},{"status":"","country":"144.144.144.144en","city":"144.144.144.144en"},{"status":"","country":"145.145.145.145en","city":"145.145.145.145en"},{"status":"","country":"146.146.146.146en","city":"146.146.146.146en"},{"status":"","country":"147.147.147.147en","city":"147.147.147.147en"},{"status":"","country":"148.148.148.148en","city":"148.148.148.148en"}]`
 	if body != expectedBody {
 		t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
 	}
@@ -294,7 +309,7 @@ func TestCache(t *testing.T) {
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	go batches.ProcessLoop()
 
@@ -338,12 +353,76 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestMergeFields(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	currentTime := time.Now()
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	tests := []struct {
+		forward  time.Duration
+		fields   string
+		expected string
+		requests int
+	}{
+		{0, "country,city", `{"country":"Some Country","city":"Some City"}`, 1},
+		// Only isp and query are fetched and merged into the cached entry.
+		{time.Second * 30, "isp,query", `{"isp":"","query":"1.1.1.1"}`, 2},
+		{0, "country,city,isp,query", `{"country":"Some Country","city":"Some City","isp":"","query":"1.1.1.1"}`, 2},
+		{0, "country", `{"country":"Some Country"}`, 2},
+		// country and city expired, isp and query didn't.
+		{time.Second * 40, "isp", `{"isp":""}`, 2},
+		{0, "city,query", `{"city":"Some City","query":"1.1.1.1"}`, 3},
+		{0, "country,city,isp,query", `{"country":"Some Country","city":"Some City","isp":"","query":"1.1.1.1"}`, 4},
+	}
+
+	for i, test := range tests {
+		currentTime = currentTime.Add(test.forward)
+
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI("http://example.com/json/1.1.1.1?fields=" + test.fields)
+		ctx.Init(&req, nil, nil)
+
+		h.Index(&ctx)
+
+		body := string(ctx.Response.Body())
+		if body != test.expected {
+			t.Errorf("%d: \nexpected\n%s\ngot\n%s", i, test.expected, body)
+		}
+
+		client.Lock()
+		requests := len(client.Requests)
+		client.Unlock()
+		if requests != test.requests {
+			t.Errorf("%d: expected %d requests got %d", i, test.requests, requests)
+		}
+	}
+}
+
 func TestHammer(t *testing.T) {
 	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
 
 	cache := cache.New(1000000)
 	client := &fetcher.Mock{}
-	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
 
 	go batches.ProcessLoop()
 
@@ -419,3 +498,873 @@ func TestHammer(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+	cfg.CacheStaleWhileRevalidate = time.Minute
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	currentTime := time.Now()
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	request := func() *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI("http://example.com/json/1.1.1.1?fields=" + strconv.Itoa(int(field.FromCSV("country,city,query"))))
+		ctx.Init(&req, nil, nil)
+
+		go func() {
+			time.Sleep(time.Millisecond * 10)
+			batches.Process()
+		}()
+
+		h.Index(&ctx)
+
+		body := string(ctx.Response.Body())
+		expectedBody := `{"country":"Some Country","city":"Some City","query":"1.1.1.1"}`
+		if body != expectedBody {
+			t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
+		}
+
+		return &ctx
+	}
+
+	if ctx := request(); len(ctx.Response.Header.Peek("X-Cache")) != 0 {
+		t.Errorf("expected no X-Cache header got %q", ctx.Response.Header.Peek("X-Cache"))
+	}
+
+	// Our mock fetcher caches for one minute, so the entry is now expired but within the stale window.
+	currentTime = currentTime.Add(time.Second * 90)
+
+	if ctx := request(); string(ctx.Response.Header.Peek("X-Cache")) != "STALE" {
+		t.Errorf("expected X-Cache: STALE got %q", ctx.Response.Header.Peek("X-Cache"))
+	}
+
+	// Wait for the background refresh to be done.
+	time.Sleep(time.Millisecond * 50)
+
+	if ctx := request(); len(ctx.Response.Header.Peek("X-Cache")) != 0 {
+		t.Errorf("expected no X-Cache header got %q", ctx.Response.Header.Peek("X-Cache"))
+	}
+
+	client.Lock()
+	defer client.Unlock()
+	if len(client.Requests) != 2 {
+		t.Errorf("expected 2 got %d", len(client.Requests))
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+	cfg.CacheStaleIfError = time.Hour
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	// Our mock fetcher always fails for 1.2.3.4.
+	batches.Restore([]*structs.CacheEntry{{
+		IP:       "1.2.3.4",
+		Lang:     "en",
+		Fields:   field.FromCSV("country,city,query"),
+		Expires:  time.Now().Add(-time.Minute * 10),
+		Response: fetcher.MockResponseFor("1.2.3.4en"),
+	}})
+
+	for _, tc := range []struct {
+		ip           string
+		expectedBody string
+		expectStale  bool
+	}{
+		{"1.2.3.4", `{"country":"1.2.3.4en","city":"1.2.3.4en","query":"1.2.3.4"}`, true},
+		{"1.1.1.1", `{"country":"Some Country","city":"Some City","query":"1.1.1.1"}`, false},
+	} {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI("http://example.com/json/" + tc.ip + "?fields=country,city,query")
+		ctx.Init(&req, nil, nil)
+
+		h.Index(&ctx)
+
+		body := string(ctx.Response.Body())
+		if body != tc.expectedBody {
+			t.Errorf("\nexpected\n%s\ngot\n%s", tc.expectedBody, body)
+		}
+
+		if stale := string(ctx.Response.Header.Peek("X-Cache")) == "STALE"; stale != tc.expectStale {
+			t.Errorf("%s: expected stale %v got %v", tc.ip, tc.expectStale, stale)
+		}
+	}
+}
+
+func TestSpecialRanges(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	var ctx fasthttp.RequestCtx
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/json/192.168.1.1")
+	ctx.Init(&req, nil, nil)
+
+	h.Index(&ctx)
+
+	body := string(ctx.Response.Body())
+	expectedBody := `{"status":"fail","message":"private range","query":"192.168.1.1"}`
+	if body != expectedBody {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
+	}
+
+	var batchCtx fasthttp.RequestCtx
+	var batchReq fasthttp.Request
+	batchReq.SetRequestURI("http://example.com/batch")
+	batchReq.SetBodyString(`["127.0.0.1",{"query":"fd00::1"},"::1"]`)
+	batchCtx.Init(&batchReq, nil, nil)
+
+	h.Index(&batchCtx)
+
+	body = string(batchCtx.Response.Body())
+	expectedBody = `[{"status":"fail","message":"reserved range","query":"127.0.0.1"},{"status":"fail","message":"private range","query":"fd00::1"},{"status":"fail","message":"reserved range","query":"::1"}]`
+	if body != expectedBody {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
+	}
+
+	client.Lock()
+	defer client.Unlock()
+	if len(client.Requests) != 0 {
+		t.Errorf("expected 0 got %d", len(client.Requests))
+	}
+}
+
+func TestSelf(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, proxy, _ := net.ParseCIDR("192.168.1.1/32")
+
+	h := handlers.Handler{
+		Logger:         logger.With().Str("part", "handler").Logger(),
+		Batches:        batches,
+		Client:         client,
+		TrustedProxies: []*net.IPNet{private, proxy},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		remote   string
+		header   string
+		value    string
+		expected string
+	}{
+		{"direct", "1.1.1.1", "", "", "1.1.1.1"},
+		{"untrusted", "1.1.1.1", "X-Forwarded-For", "2.2.2.2", "1.1.1.1"},
+		{"x-forwarded-for", "10.0.0.1", "X-Forwarded-For", "9.9.9.9, 2.2.2.2, 192.168.1.1", "2.2.2.2"},
+		{"x-real-ip", "192.168.1.1", "X-Real-IP", "3.3.3.3", "3.3.3.3"},
+		{"forwarded", "10.0.0.1", "Forwarded", `for=4.4.4.4:1234;proto=https, for="[2606:4700::1111]:443"`, "2606:4700::1111"},
+		{"trusted without header", "10.0.0.1", "", "", "10.0.0.1"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			var req fasthttp.Request
+			req.SetRequestURI("http://example.com/json?fields=query")
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(tc.remote)}, nil)
+
+			h.Index(&ctx)
+
+			body := string(ctx.Response.Body())
+			expectedBody := `{"query":"` + tc.expected + `"}`
+			if body != expectedBody {
+				t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
+			}
+		})
+	}
+}
+
+type staticResolver map[string]string
+
+func (s staticResolver) Resolve(host string) (net.IP, error) {
+	if ip, ok := s[host]; ok {
+		return net.ParseIP(ip), nil
+	}
+	return nil, resolve.ErrNotFound
+}
+
+func TestHostname(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+		Resolver: staticResolver{
+			"one.example.com":   "1.1.1.1",
+			"local.example.com": "127.0.0.1",
+		},
+	}
+
+	var ctx fasthttp.RequestCtx
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/json/one.example.com?fields=country,query")
+	ctx.Init(&req, nil, nil)
+
+	h.Index(&ctx)
+
+	body := string(ctx.Response.Body())
+	expectedBody := `{"country":"Some Country","query":"1.1.1.1"}`
+	if body != expectedBody {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
+	}
+
+	var batchCtx fasthttp.RequestCtx
+	var batchReq fasthttp.Request
+	batchReq.SetRequestURI("http://example.com/batch?fields=country,query,status,message")
+	batchReq.SetBodyString(`["one.example.com",{"query":"local.example.com"},"unknown.example.com","not a hostname"]`)
+	batchCtx.Init(&batchReq, nil, nil)
+
+	h.Index(&batchCtx)
+
+	body = string(batchCtx.Response.Body())
+	expectedBody = `[{"status":"","country":"Some Country","message":"","query":"1.1.1.1"},{"status":"fail","message":"reserved range","query":"127.0.0.1"},{"status":"fail","message":"invalid query"},{"status":"fail","message":"invalid query"}]`
+	if body != expectedBody {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expectedBody, body)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	for _, tc := range []struct {
+		uri                 string
+		body                string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			"/xml/2.2.2.2?fields=status,country,lat,isp,query", "",
+			"application/xml; charset=utf-8",
+			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<query>\n  <status>success</status>\n  <country>Some other Country</country>\n  <lat>13</lat>\n  <isp>Some other ISP</isp>\n  <query>2.2.2.2</query>\n</query>\n",
+		},
+		{
+			"/csv/2.2.2.2?fields=status,country,lat,isp,query", "",
+			"text/csv; charset=utf-8",
+			"success,Some other Country,13,Some other ISP,2.2.2.2\n",
+		},
+		{
+			"/line/2.2.2.2?fields=status,country,lat,isp,query", "",
+			"text/plain; charset=utf-8",
+			"success\nSome other Country\n13\nSome other ISP\n2.2.2.2\n",
+		},
+		{
+			"/php/2.2.2.2?fields=status,country,lat,isp,query", "",
+			"text/plain; charset=utf-8",
+			`a:5:{s:6:"status";s:7:"success";s:7:"country";s:18:"Some other Country";s:3:"lat";d:13;s:3:"isp";s:14:"Some other ISP";s:5:"query";s:7:"2.2.2.2";}`,
+		},
+		{
+			"/csv/10.0.0.1", "",
+			"text/csv; charset=utf-8",
+			"fail,private range,10.0.0.1\n",
+		},
+		{
+			"/json/2.2.2.2?fields=country&callback=cb", "",
+			"application/javascript; charset=utf-8",
+			`cb({"country":"Some other Country"});`,
+		},
+		{
+			"/batch?fields=country&callback=jQuery.cb_1", `["2.2.2.2"]`,
+			"application/javascript; charset=utf-8",
+			`jQuery.cb_1([{"country":"Some other Country"}]);`,
+		},
+		{
+			"/json/2.2.2.2?callback=alert(1)", "",
+			"application/json",
+			`{"status":"fail","message":"invalid callback"}`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.uri, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			var req fasthttp.Request
+			req.SetRequestURI("http://example.com" + tc.uri)
+			if tc.body != "" {
+				req.SetBodyString(tc.body)
+			}
+			ctx.Init(&req, nil, nil)
+
+			h.Index(&ctx)
+
+			contentType := string(ctx.Response.Header.Peek(fasthttp.HeaderContentType))
+			if contentType != tc.expectedContentType {
+				t.Errorf("expected %q got %q", tc.expectedContentType, contentType)
+			}
+
+			body := string(ctx.Response.Body())
+			if body != tc.expectedBody {
+				t.Errorf("\nexpected\n%s\ngot\n%s", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestMMDBFallback(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+	cfg.MMDBFile = []string{filepath.Join("internal", "mmdb", "testdata", "test-city.mmdb")}
+
+	secondary, err := fetcher.NewMMDB(logger, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Our mock fetcher always fails for 1.2.3.4.
+	client, err := fetcher.NewFallback(logger, &fetcher.Mock{}, secondary, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := cache.New(1000000)
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	for _, tc := range []struct {
+		uri            string
+		expectedBody   string
+		expectedSource string
+	}{
+		{
+			"/json/1.2.3.4?fields=status,country,countryCode,city,lat,lon,timezone,offset,as,query",
+			`{"status":"success","country":"Some Country","countryCode":"SC","city":"Some City","lat":13,"lon":37,"timezone":"UTC","offset":0,"as":"AS64496 Some ISP","query":"1.2.3.4"}`,
+			"mmdb",
+		},
+		{
+			// isp wasn't fetched yet.
+			"/json/1.2.3.4?fields=country,isp",
+			`{"country":"Some Country","isp":"Some ISP"}`,
+			"mmdb",
+		},
+		{
+			"/json/1.1.1.1?fields=country,city,query",
+			`{"country":"Some Country","city":"Some City","query":"1.1.1.1"}`,
+			"",
+		},
+	} {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI("http://example.com" + tc.uri)
+		ctx.Init(&req, nil, nil)
+
+		h.Index(&ctx)
+
+		body := string(ctx.Response.Body())
+		if body != tc.expectedBody {
+			t.Errorf("\nexpected\n%s\ngot\n%s", tc.expectedBody, body)
+		}
+
+		if source := string(ctx.Response.Header.Peek("X-Source")); source != tc.expectedSource {
+			t.Errorf("%s: expected source %q got %q", tc.uri, tc.expectedSource, source)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	requests := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+	}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.OtelEndpoint = server.URL
+
+	tracer := trace.New(logger, cfg)
+	trace.Default = tracer
+	defer func() {
+		trace.Default = nil
+	}()
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	var ctx fasthttp.RequestCtx
+	var req fasthttp.Request
+	req.SetRequestURI("http://example.com/json/1.1.1.1")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx.Init(&req, nil, nil)
+
+	h.Index(&ctx)
+
+	// The batch span ends after the request is answered.
+	time.Sleep(time.Millisecond * 50)
+	tracer.Flush(time.Now().Add(time.Second * 5))
+
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Links        []struct {
+						SpanID string `json:"spanId"`
+					} `json:"links"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(<-requests, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]string)
+	var serverLinks []string
+	for _, s := range export.ResourceSpans[0].ScopeSpans[0].Spans {
+		names[s.SpanID] = s.Name
+
+		if s.Name == "HTTP GET /json" {
+			if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID != "00f067aa0ba902b7" {
+				t.Errorf("expected the traceparent to be the parent got %s %s", s.TraceID, s.ParentSpanID)
+			}
+			for _, l := range s.Links {
+				serverLinks = append(serverLinks, l.SpanID)
+			}
+		}
+	}
+
+	if len(serverLinks) != 1 {
+		t.Fatalf("expected 1 link got %v", serverLinks)
+	}
+	if name := names[serverLinks[0]]; name != "batch" {
+		t.Errorf("expected the request to link to the batch span got %q", name)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	get := func(uri string) (int, string) {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI("http://example.com" + uri)
+		ctx.Init(&req, nil, nil)
+
+		h.Index(&ctx)
+
+		return ctx.Response.StatusCode(), string(ctx.Response.Body())
+	}
+
+	for _, uri := range []string{"/healthz", "/readyz"} {
+		if code, body := get(uri); code != fasthttp.StatusOK || body != `{"problems":[],"status":"ok"}`+"\n" {
+			t.Errorf("%s: expected 200 ok got %d %s", uri, code, body)
+		}
+	}
+
+	// Our mock fetcher always fails for 1.2.3.4, fail 4 out of 6 batches.
+	for i := 0; i < 6; i++ {
+		ip := "1.2.3.4"
+		if i%3 == 0 {
+			ip = strconv.Itoa(i+1) + ".1.1.1"
+		}
+		get("/json/" + ip)
+	}
+
+	if code, body := get("/readyz"); code != fasthttp.StatusServiceUnavailable || body != `{"problems":["4 of the last 6 upstream batches failed"],"status":"fail"}`+"\n" {
+		t.Errorf("expected 503 got %d %s", code, body)
+	}
+
+	// Still alive.
+	if code, _ := get("/healthz"); code != fasthttp.StatusOK {
+		t.Errorf("expected 200 got %d", code)
+	}
+}
+
+// blockingClient blocks Fetch until unblock is closed.
+type blockingClient struct {
+	fetcher.Mock
+	unblock chan struct{}
+}
+
+func (c *blockingClient) Fetch(m map[string]*structs.CacheEntry, span *trace.Span) error {
+	<-c.unblock
+	return c.Mock.Fetch(m, span)
+}
+
+func TestDrain(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+	cfg.BatchDelay = time.Hour // Only Drain sends batches.
+
+	cache := cache.New(1000000)
+	client := &blockingClient{unblock: make(chan struct{})}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	_, c := batches.Add("1.1.1.1", "en", field.Default, nil)
+	if c == nil {
+		t.Fatal("expected the entry to be fetched")
+	}
+
+	if running := batches.Drain(time.Now().Add(time.Millisecond * 50)); running != 1 {
+		t.Errorf("expected 1 running batch after the deadline got %d", running)
+	}
+
+	close(client.unblock)
+
+	if running := batches.Drain(time.Now().Add(time.Second)); running != 0 {
+		t.Errorf("expected no running batches got %d", running)
+	}
+
+	select {
+	case <-c:
+	default:
+		t.Fatal("expected the batch to be done")
+	}
+
+	if len(client.Requests) != 1 {
+		t.Errorf("expected 1 request got %v", client.Requests)
+	}
+}
+
+func TestMergeRunning(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+	cfg.BatchDelay = time.Hour // Only Drain sends batches.
+
+	cache := cache.New(1000000)
+	client := &blockingClient{unblock: make(chan struct{})}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	// Neither entry has a cached base, so the second batch only fetches isp.
+	batches.Add("1.1.1.1", "en", field.FromCSV("country,city"), nil)
+	batches.Drain(time.Now().Add(time.Millisecond * 10))
+	batches.Add("1.1.1.1", "en", field.FromCSV("isp"), nil)
+	if running := batches.Drain(time.Now().Add(time.Millisecond * 10)); running != 2 {
+		t.Fatalf("expected 2 running batches got %d", running)
+	}
+
+	close(client.unblock)
+	batches.Drain(time.Now().Add(time.Second))
+
+	// Whichever batch finished last, the cached entry has the fields of both.
+	if _, c := batches.Add("1.1.1.1", "en", field.FromCSV("country,city,isp"), nil); c != nil {
+		t.Error("expected the fields of both batches to be cached")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	dir, err := ioutil.TempDir("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(`[
+		{"name": "search", "key": "secret", "enabled": true, "fields": "country,city", "languages": ["en"]},
+		{"name": "old", "key": "expired", "enabled": false}
+	]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tenants, err := tenant.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, config.Default())
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+		Tenants: tenants,
+	}
+
+	tests := []struct {
+		method        string
+		uri           string
+		authorization string
+		body          string
+		code          int
+		expected      string
+	}{
+		{"GET", "/json/1.1.1.1", "", "", 403, `{"status":"fail","message":"invalid/expired key"}`},
+		{"GET", "/json/1.1.1.1?key=expired", "", "", 403, `{"status":"fail","message":"invalid/expired key"}`},
+		{"GET", "/csv/1.1.1.1?key=wrong", "", "", 403, "fail,invalid/expired key\n"},
+		{"GET", "/json/1.1.1.1?key=secret&fields=country,city,isp,query", "", "", 200, `{"country":"Some Country","city":"Some City"}`},
+		{"GET", "/json/1.1.1.1?fields=country,isp", "Bearer secret", "", 200, `{"country":"Some Country"}`},
+		{"GET", "/json/1.1.1.1?lang=de", "secret", "", 200, `{"status":"fail","message":"invalid language"}`},
+		{"POST", "/batch", "", `["1.1.1.1"]`, 403, `[{"status":"fail","message":"invalid/expired key"}]`},
+		{"POST", "/batch?fields=city,isp", "Bearer secret", `["1.1.1.1", {"query": "1.1.1.1", "fields": "country,isp", "lang": "de"}]`, 200, `[{"city":"Some City"},{"country":"Some Country"}]`},
+	}
+
+	for _, test := range tests {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.Header.SetMethod(test.method)
+		req.SetRequestURI("http://example.com" + test.uri)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		req.SetBodyString(test.body)
+		ctx.Init(&req, nil, nil)
+
+		h.Index(&ctx)
+
+		if code := ctx.Response.StatusCode(); code != test.code {
+			t.Errorf("%s %s: expected %d got %d", test.method, test.uri, test.code, code)
+		}
+		if body := string(ctx.Response.Body()); body != test.expected {
+			t.Errorf("%s %s:\nexpected\n%s\ngot\n%s", test.method, test.uri, test.expected, body)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+	cfg.RateLimitHits = 3
+	cfg.RateLimitFetches = 2
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	go batches.ProcessLoop()
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+		Limiter: ratelimit.New(cfg),
+	}
+
+	tests := []struct {
+		method   string
+		uri      string
+		body     string
+		code     int
+		rl       string
+		ttl      string
+		expected string
+	}{
+		{"GET", "/json/1.1.1.1?fields=country", "", 200, "1", "30", `{"country":"Some Country"}`},
+		// 1.1.1.1 isn't cached with the default fields, so all 3 need a fetch. That is more than
+		// RATE_LIMIT_FETCHES, so it is never allowed and there is no X-Ttl.
+		{"POST", "/batch", `["1.1.1.1", "2.2.2.2", "3.3.3.3"]`, 429, "1", "", `[{"status":"fail","message":"batch larger than the rate limit"}]`},
+		{"POST", "/batch", `["2.2.2.2", "3.3.3.3"]`, 429, "1", "30", `[{"status":"fail","message":"too many requests"}]`},
+		// Special ranges and invalid queries don't count.
+		{"POST", "/batch?fields=country", `["1.1.1.1", "2.2.2.2", "10.0.0.1", "invalid"]`, 200, "0", "60", `[{"country":"Some Country"},{"country":"Some other Country"},{},{}]`},
+		{"GET", "/json/1.1.1.1?fields=country", "", 200, "0", "60", `{"country":"Some Country"}`},
+		{"GET", "/line/3.3.3.3", "", 429, "0", "30", "fail\ntoo many requests\n"},
+	}
+
+	for _, test := range tests {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.Header.SetMethod(test.method)
+		req.SetRequestURI("http://example.com" + test.uri)
+		req.SetBodyString(test.body)
+		ctx.Init(&req, nil, nil)
+
+		h.Index(&ctx)
+
+		if code := ctx.Response.StatusCode(); code != test.code {
+			t.Errorf("%s %s: expected %d got %d", test.method, test.uri, test.code, code)
+		}
+		if rl, ttl := string(ctx.Response.Header.Peek("X-Rl")), string(ctx.Response.Header.Peek("X-Ttl")); rl != test.rl || ttl != test.ttl {
+			t.Errorf("%s %s: expected X-Rl %s X-Ttl %s got %s %s", test.method, test.uri, test.rl, test.ttl, rl, ttl)
+		}
+		if body := string(ctx.Response.Body()); body != test.expected {
+			t.Errorf("%s %s:\nexpected\n%s\ngot\n%s", test.method, test.uri, test.expected, body)
+		}
+	}
+}
+
+func TestBudgetSoftLimit(t *testing.T) {
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true})
+
+	cfg := config.Default()
+
+	cache := cache.New(1000000)
+	client := &fetcher.Mock{}
+	batches := batch.New(logger.With().Str("part", "batch").Logger(), cache, client, cfg)
+
+	h := handlers.Handler{
+		Logger:  logger.With().Str("part", "handler").Logger(),
+		Batches: batches,
+		Client:  client,
+	}
+
+	currentTime := time.Now()
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	request := func(uri string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		var req fasthttp.Request
+		req.SetRequestURI(uri)
+		ctx.Init(&req, nil, nil)
+
+		go func() {
+			time.Sleep(time.Millisecond * 10)
+			batches.Process()
+		}()
+
+		h.Index(&ctx)
+
+		return &ctx
+	}
+
+	if ctx := request("http://example.com/json/1.1.1.1?fields=country"); len(ctx.Response.Header.Peek("X-Cache")) != 0 {
+		t.Errorf("expected no X-Cache header got %q", ctx.Response.Header.Peek("X-Cache"))
+	}
+
+	client.Lock()
+	client.SoftLimit = true
+	client.Unlock()
+
+	// Long expired, but past the soft limit it's still used.
+	currentTime = currentTime.Add(time.Hour * 24 * 30)
+
+	ctx := request("http://example.com/json/1.1.1.1?fields=country")
+	if string(ctx.Response.Header.Peek("X-Cache")) != "STALE" {
+		t.Errorf("expected X-Cache: STALE got %q", ctx.Response.Header.Peek("X-Cache"))
+	}
+	if body, expected := string(ctx.Response.Body()), `{"country":"Some Country"}`; body != expected {
+		t.Errorf("expected %s got %s", expected, body)
+	}
+
+	// Fields that were never fetched still have to be.
+	if ctx := request("http://example.com/json/1.1.1.1?fields=city"); len(ctx.Response.Header.Peek("X-Cache")) != 0 {
+		t.Errorf("expected no X-Cache header got %q", ctx.Response.Header.Peek("X-Cache"))
+	}
+
+	// Wait for any background refresh.
+	time.Sleep(time.Millisecond * 50)
+
+	client.Lock()
+	defer client.Unlock()
+	if len(client.Requests) != 2 {
+		t.Errorf("expected 2 got %d", len(client.Requests))
+	}
+}
@@ -1,28 +1,98 @@
 package batch
 
 import (
-	"os"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 
+	"github.com/ip-api/proxy/internal/budget"
 	"github.com/ip-api/proxy/internal/cache"
+	"github.com/ip-api/proxy/internal/config"
 	"github.com/ip-api/proxy/internal/fetcher"
 	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/metrics"
 	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/trace"
+	"github.com/ip-api/proxy/internal/util"
 )
 
 const (
 	maxBatchEntries = 100
+
+	// How old entries can be when they are preferred over fetching them because of the upstream budget.
+	budgetMaxStale = time.Hour * 24 * 365
+)
+
+// Reasons for a batch to be sent upstream.
+const (
+	flushTimer    = "timer"
+	flushFull     = "full"
+	flushShutdown = "shutdown"
+)
+
+var (
+	metricBatchSize = metrics.NewHistogramVec(
+		"ipapi_proxy_batch_size",
+		"Number of entries in batches sent upstream.",
+		[]float64{1, 2, 5, 10, 20, 50, 100},
+		"reason",
+	)
+	metricBatchErrors  = metrics.NewCounter("ipapi_proxy_batch_errors_total", "Number of batches that failed upstream.")
+	metricBatchRunning = metrics.NewGauge("ipapi_proxy_batch_running", "Number of batches currently being fetched upstream.")
+	metricStale        = metrics.NewCounterVec("ipapi_proxy_stale_responses_total", "Number of expired entries served per reason.", "reason")
+	metricRefreshes    = metrics.NewCounter("ipapi_proxy_background_refreshes_total", "Number of expired entries queued for a background refresh.")
 )
 
 type batch struct {
 	entries map[string]*structs.CacheEntry
 	c       chan struct{}
+
+	// Cached entries that only miss some fields. Only the missing fields are fetched
+	// and then merged with the fields of these entries.
+	bases   map[string]*structs.CacheEntry
+	created time.Time
+
+	// Requests served by the batch link to this span.
+	span *trace.Span
+}
+
+func newBatch(size int) *batch {
+	return &batch{
+		entries: make(map[string]*structs.CacheEntry, size),
+		c:       make(chan struct{}),
+		bases:   make(map[string]*structs.CacheEntry),
+	}
+}
+
+// add adds an entry to the batch. The batch is created, and its span started, with the first entry.
+func (bt *batch) add(key string, entry *structs.CacheEntry) {
+	if len(bt.entries) == 0 {
+		bt.created = util.Now()
+		bt.span = trace.Start("batch", trace.SpanContext{}, trace.KindInternal)
+	}
+
+	bt.entries[key] = entry
+}
+
+// link links span to the span of the batch.
+// If span is sampled the batch is sampled as well so the trace is complete.
+func (bt *batch) link(span *trace.Span) {
+	span.AddLink(bt.span.Context())
+	if span.Sampled() {
+		bt.span.SetSampled()
+	}
 }
 
 type Batches struct {
+	// Unix nanoseconds of the last iteration of ProcessLoop, or of when Batches was created.
+	// First in the struct so it is 64-bit aligned for atomic access.
+	lastLoop int64
+	// BATCH_DELAY as a time.Duration, accessed atomically so it can be reloaded.
+	delay int64
+
 	mu sync.Mutex
 
 	next    *batch
@@ -31,46 +101,93 @@ type Batches struct {
 	logger zerolog.Logger
 	cache  *cache.Cache
 	client fetcher.Client
+
+	// For how long expired entries are served while they are refreshed in the background.
+	staleWhileRevalidate time.Duration
+	// For how long expired entries are served when refreshing them failed.
+	staleIfError time.Duration
+
+	// The outcome of the last batches, used for readiness checks.
+	outcomes    [healthBatches]outcome
+	outcomesPos int
 }
 
-func New(logger zerolog.Logger, cache *cache.Cache, client fetcher.Client) *Batches {
+func New(logger zerolog.Logger, cache *cache.Cache, client fetcher.Client, cfg config.Config) *Batches {
 	return &Batches{
-		next: &batch{
-			entries: make(map[string]*structs.CacheEntry),
-			c:       make(chan struct{}),
-		},
+		next:    newBatch(0),
 		running: make([]*batch, 0),
 		logger:  logger,
 		cache:   cache,
 		client:  client,
+
+		staleWhileRevalidate: cfg.CacheStaleWhileRevalidate,
+		staleIfError:         cfg.CacheStaleIfError,
+		delay:                int64(cfg.BatchDelay),
+		lastLoop:             time.Now().UnixNano(),
 	}
 }
 
-func (b *Batches) ProcessLoop() {
-	delay := time.Millisecond * 10
-	if v := os.Getenv("BATCH_DELAY"); v != "" {
-		if d, err := time.ParseDuration(v); err != nil {
-			b.logger.Error().Err(err).Msg("invalid BATCH_DELAY")
-		} else {
-			delay = d
-		}
-	}
+// Reload applies BATCH_DELAY from cfg, starting with the next iteration of ProcessLoop.
+func (b *Batches) Reload(cfg config.Config) {
+	atomic.StoreInt64(&b.delay, int64(cfg.BatchDelay))
+}
 
+func (b *Batches) batchDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.delay))
+}
+
+func (b *Batches) ProcessLoop() {
 	for {
-		time.Sleep(delay)
+		time.Sleep(b.batchDelay())
 
 		b.Process()
+
+		atomic.StoreInt64(&b.lastLoop, time.Now().UnixNano())
 	}
 }
 
 func (b *Batches) Process() {
 	b.mu.Lock()
-	b.processLocked()
+	b.processLocked(flushTimer)
 	b.mu.Unlock()
 }
 
+// Drain sends the pending batch upstream right away and waits for all running batches,
+// including batches added in the meantime, until there are none left or deadline passed.
+// Fetch waits for its reverse lookups, so those are done as well.
+// It returns the number of batches that were still running at the deadline.
+func (b *Batches) Drain(deadline time.Time) int {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		b.mu.Lock()
+		b.processLocked(flushShutdown)
+		running := make([]chan struct{}, 0, len(b.running))
+		for _, r := range b.running {
+			running = append(running, r.c)
+		}
+		b.mu.Unlock()
+
+		if len(running) == 0 {
+			return 0
+		}
+
+		for _, c := range running {
+			select {
+			case <-c:
+			case <-timer.C:
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				return len(b.running)
+			}
+		}
+	}
+}
+
 // processLocked assumes b.mu is already locked.
-func (b *Batches) processLocked() {
+// reason is only used for metrics.
+func (b *Batches) processLocked(reason string) {
 	var running *batch
 
 	if len(b.next.entries) == 0 {
@@ -81,27 +198,66 @@ func (b *Batches) processLocked() {
 
 	b.running = append(b.running, b.next)
 	running = b.next
-	b.next = &batch{
-		entries: make(map[string]*structs.CacheEntry, len(b.next.entries)),
-		c:       make(chan struct{}),
-	}
+	b.next = newBatch(len(b.next.entries))
 
 	b.logger.Debug().Msgf("batch with %d entries", len(running.entries))
 
+	metricBatchSize.With(reason).Observe(float64(len(running.entries)))
+	metricBatchRunning.Inc()
+
+	running.span.SetAttribute("reason", reason)
+	running.span.SetAttribute("entries", len(running.entries))
+
+	// The fetcher modifies the fields of entries, so remember which fields
+	// were requested in case we need to fall back on stale entries.
+	var requested map[string]field.Fields
+	if b.staleIfError > 0 {
+		requested = make(map[string]field.Fields, len(running.entries))
+		for key, entry := range running.entries {
+			requested[key] = entry.Fields
+		}
+	}
+
 	// Fetch multiple batches in parallel in goroutines.
 	go func() {
-		err := b.client.Fetch(running.entries)
+		err := b.client.Fetch(running.entries, running.span)
+
+		// The budget already logged reaching its hard limit, and the proxy can still
+		// answer from the cache so it doesn't count against readiness.
+		exhausted := errors.Is(err, budget.ErrExhausted)
 
 		if err != nil {
-			b.logger.Error().Err(err).Msg("error in upstream")
+			if exhausted {
+				b.logger.Debug().Err(err).Msg("error in upstream")
+			} else {
+				b.logger.Error().Err(err).Msg("error in upstream")
+			}
+			metricBatchErrors.Inc()
+			running.span.SetError(err)
 		}
 
 		b.mu.Lock()
 		{
+			if !exhausted {
+				b.recordLocked(err)
+			}
+
 			if err == nil {
 				for key, entry := range running.entries {
+					if base, ok := running.bases[key]; ok {
+						// Use the time the batch was created as all fields that were fresh
+						// when the entry was added have to be returned.
+						entry.MergeOlder(base, running.created)
+					}
+					// Another batch might have cached more fields since, keep the ones that are still fresh.
+					if current := b.cache.Peek(key); current != nil {
+						entry.MergeOlder(current, util.Now())
+					}
+
 					b.cache.Add(key, entry)
 				}
+			} else if b.staleIfError > 0 {
+				b.useStaleLocked(running, requested)
 			}
 
 			for i, n := range b.running {
@@ -116,27 +272,103 @@ func (b *Batches) processLocked() {
 			close(running.c)
 		}
 		b.mu.Unlock()
+
+		running.span.End()
+		metricBatchRunning.Dec()
 	}()
 }
 
-func (b *Batches) Add(ip string, lang string, fields field.Fields) (*structs.CacheEntry, chan struct{}) {
+// Cached returns true if Add can return the entry for ip and lang with fields from the cache,
+// without fetching it upstream. Entries that are stale while revalidating count as cached.
+// Unlike Add it doesn't count in the cache metrics.
+func (b *Batches) Cached(ip string, lang string, fields field.Fields) bool {
+	now := util.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cached := b.cache.Peek(ip + lang)
+	if cached == nil {
+		return false
+	}
+
+	return cached.FreshFields(now.Add(-b.staleWhileRevalidate)).Contains(fields)
+}
+
+// Add returns the entry for ip and lang. If the channel isn't nil the entry is being fetched
+// and is only valid once the channel is closed.
+// span is linked to the span of the batch that fetches the entry.
+func (b *Batches) Add(ip string, lang string, fields field.Fields, span *trace.Span) (*structs.CacheEntry, chan struct{}) {
 	key := ip + lang
+	now := util.Now()
+
+	s := span.Child("batch add", trace.KindInternal)
+	defer s.End()
 
+	lockStart := time.Now()
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	s.SetAttribute("lock_wait_us", int64(time.Since(lockStart)/time.Microsecond))
+
+	// The fields we need to fetch.
+	need := fields
+
+	// Past the soft limit of the upstream budget entries of any age are used.
+	preferStale := b.client.PreferStale()
+	maxStale := b.staleWhileRevalidate
+	if preferStale {
+		maxStale = budgetMaxStale
+	}
+
+	cached, _ := b.cache.GetStale(key, maxStale)
+	if cached != nil {
+		fresh := cached.FreshFields(now)
 
-	entry := b.cache.Get(key)
-	if entry != nil {
 		// Does the cached entry contain all the fields we need to return?
-		if entry.Fields.Contains(fields) {
-			return entry, nil
+		if fresh.Contains(fields) {
+			s.SetAttribute("cache", "hit")
+			return cached, nil
+		}
+
+		if preferStale && cached.Fields.Contains(fields) {
+			// Don't refresh anything, that would spend the budget.
+			metricStale.With("budget").Inc()
+			s.SetAttribute("cache", "stale")
+
+			e := *cached
+			e.Stale = true
+			return &e, nil
+		}
+
+		if b.staleWhileRevalidate > 0 && cached.FreshFields(now.Add(-b.staleWhileRevalidate)).Contains(fields) {
+			// Refresh all expired fields, not just the requested ones.
+			b.refreshLocked(key, cached, cached.Fields.Remove(fresh))
+			metricStale.With("revalidate").Inc()
+			s.SetAttribute("cache", "stale")
+
+			// Return a copy so the cached entry itself isn't marked as stale.
+			e := *cached
+			e.Stale = true
+			return &e, nil
 		}
+
+		need = fields.Remove(fresh)
 	}
 
 	// Check if the requested fields and IP are already in an outgoing batch request.
 	for _, r := range b.running {
 		entry, ok := r.entries[key]
-		if ok && entry.Fields.Contains(fields) {
+		if !ok {
+			continue
+		}
+
+		covered := entry.Fields
+		if base, ok := r.bases[key]; ok {
+			covered = covered.Merge(base.FreshFields(now))
+		}
+		if covered.Contains(fields) {
+			s.SetAttribute("cache", "running")
+			r.link(span)
 			return entry, r.c
 		}
 	}
@@ -144,24 +376,115 @@ func (b *Batches) Add(ip string, lang string, fields field.Fields) (*structs.Cac
 	entry, ok := b.next.entries[key]
 	if ok {
 		// Make sure all fields are in the entry.
-		entry.Fields = entry.Fields.Merge(fields)
+		// Fields the base of the entry contains don't need to be fetched.
+		if base, ok := b.next.bases[key]; ok {
+			need = fields.Remove(base.FreshFields(now))
+		} else {
+			need = fields
+		}
+		entry.Fields = entry.Fields.Merge(need)
 
+		s.SetAttribute("cache", "queued")
+		b.next.link(span)
 		return entry, b.next.c
 	}
 
 	entry = &structs.CacheEntry{
 		IP:       ip,
 		Lang:     lang,
-		Fields:   fields,
+		Fields:   need,
 		Response: structs.ErrorResponse("fail", "error in upstream"),
 	}
-	b.next.entries[key] = entry
+	b.next.add(key, entry)
+	if cached != nil {
+		b.next.bases[key] = cached
+	}
 
+	s.SetAttribute("cache", "miss")
+	b.next.link(span)
 	c := b.next.c
 
 	if len(b.next.entries) >= maxBatchEntries {
-		b.processLocked()
+		b.processLocked(flushFull)
 	}
 
 	return entry, c
 }
+
+// useStaleLocked replaces the responses of a failed batch with expired cache entries
+// that are still within the stale-if-error window.
+// useStaleLocked assumes b.mu is already locked.
+func (b *Batches) useStaleLocked(failed *batch, requested map[string]field.Fields) {
+	for key, entry := range failed.entries {
+		stale, _ := b.cache.GetStale(key, b.staleIfError)
+		if stale == nil || !stale.Fields.Contains(requested[key]) {
+			continue
+		}
+
+		entry.Fields = stale.Fields
+		entry.Expires = stale.Expires
+		entry.Response = stale.Response
+		entry.Stale = true
+
+		metricStale.With("error").Inc()
+	}
+}
+
+// refreshLocked queues fields of an expired entry to be fetched again in the next batch,
+// unless they are already being fetched.
+// refreshLocked assumes b.mu is already locked.
+func (b *Batches) refreshLocked(key string, stale *structs.CacheEntry, fields field.Fields) {
+	for _, r := range b.running {
+		if entry, ok := r.entries[key]; ok && entry.Fields.Contains(fields) {
+			return
+		}
+	}
+
+	if entry, ok := b.next.entries[key]; ok {
+		entry.Fields = entry.Fields.Merge(fields)
+		if _, ok := b.next.bases[key]; !ok {
+			b.next.bases[key] = stale
+		}
+		return
+	}
+
+	b.next.add(key, &structs.CacheEntry{
+		IP:       stale.IP,
+		Lang:     stale.Lang,
+		Fields:   fields,
+		Response: structs.ErrorResponse("fail", "error in upstream"),
+	})
+	b.next.bases[key] = stale
+	metricRefreshes.Inc()
+
+	if len(b.next.entries) >= maxBatchEntries {
+		b.processLocked(flushFull)
+	}
+}
+
+// Snapshot returns all cache entries which can still be served, least recently used first.
+// Expired entries are included until STALE_WHILE_REVALIDATE and STALE_IF_ERROR have passed.
+func (b *Batches) Snapshot() []*structs.CacheEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.cache.Entries(b.MaxStale())
+}
+
+// MaxStale returns for how long expired entries can still be served.
+func (b *Batches) MaxStale() time.Duration {
+	if b.staleIfError > b.staleWhileRevalidate {
+		return b.staleIfError
+	}
+	return b.staleWhileRevalidate
+}
+
+// Restore adds entries returned by Snapshot back into the cache.
+func (b *Batches) Restore(entries []*structs.CacheEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, entry := range entries {
+		b.cache.Add(entry.IP+entry.Lang, entry)
+	}
+}
@@ -0,0 +1,68 @@
+package batch
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of recent batches to consider for readiness.
+	healthBatches = 20
+	// Only batches in this window are considered.
+	healthWindow = time.Minute * 5
+	// Don't report failures based on only a few batches.
+	healthMinBatches = 5
+
+	// ProcessLoop is considered stuck if it didn't run for this long plus BATCH_DELAY.
+	stallTimeout = time.Minute
+)
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// recordLocked records the outcome of a batch.
+// recordLocked assumes b.mu is already locked.
+func (b *Batches) recordLocked(err error) {
+	b.outcomes[b.outcomesPos] = outcome{
+		at:     time.Now(),
+		failed: err != nil,
+	}
+	b.outcomesPos = (b.outcomesPos + 1) % len(b.outcomes)
+}
+
+// Liveness returns why the batches aren't being processed, or nil if they are.
+func (b *Batches) Liveness() []string {
+	last := atomic.LoadInt64(&b.lastLoop)
+	if since := time.Since(time.Unix(0, last)); since > b.batchDelay()+stallTimeout {
+		return []string{fmt.Sprintf("batches weren't processed for %s", since.Round(time.Second))}
+	}
+
+	return nil
+}
+
+// Readiness returns why batches can't be fetched, or nil if they can.
+func (b *Batches) Readiness() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	after := time.Now().Add(-healthWindow)
+
+	total, failed := 0, 0
+	for _, o := range b.outcomes {
+		if o.at.After(after) {
+			total++
+			if o.failed {
+				failed++
+			}
+		}
+	}
+
+	if total >= healthMinBatches && failed*2 > total {
+		return []string{fmt.Sprintf("%d of the last %d upstream batches failed", failed, total)}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+// Package breaker implements a circuit breaker which stops sending requests to a PoP that is failing.
+package breaker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// State of a Breaker.
+type State int
+
+const (
+	// Closed means requests are sent.
+	Closed State = iota
+	// HalfOpen means probe requests are sent to see if the PoP recovered.
+	HalfOpen
+	// Open means no requests are sent.
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+const (
+	// Requests are counted in a sliding window of windowBuckets buckets of bucketSize.
+	bucketSize    = time.Second * 10
+	windowBuckets = 6
+	window        = bucketSize * windowBuckets
+
+	// The breaker opens when at least minRequests were sent in the window and
+	// maxErrorRate of them failed, or after maxConsecutive failures in a row.
+	minRequests    = 10
+	maxErrorRate   = 0.5
+	maxConsecutive = 5
+
+	// How long the breaker stays open before probing.
+	openFor = time.Second * 30
+
+	// How many probes in a row have to succeed to close the breaker.
+	// Only one probe is sent at a time.
+	probeSuccesses = 3
+)
+
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// Breaker tracks the outcome of requests to one PoP.
+type Breaker struct {
+	mu sync.Mutex
+
+	state       State
+	buckets     [windowBuckets]bucket
+	consecutive int
+	openedAt    time.Time
+
+	probing    bool
+	probeStart time.Time
+	probes     int
+}
+
+// New returns a closed Breaker.
+func New() *Breaker {
+	return &Breaker{}
+}
+
+// Allow returns true if a request can be sent. In the half-open state
+// it returns true for one probe at a time, whose outcome has to be recorded.
+func (b *Breaker) Allow() bool {
+	now := util.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.stateLocked(now) {
+	case Closed:
+		return true
+	case HalfOpen:
+		// Also allow a new probe if the outcome of the last one was never recorded.
+		if !b.probing || now.Sub(b.probeStart) > openFor {
+			b.probing = true
+			b.probeStart = now
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record records the outcome of a request and returns the new state, and if it changed.
+func (b *Breaker) Record(success bool) (State, bool) {
+	now := util.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous := b.stateLocked(now)
+
+	switch previous {
+	case Closed:
+		bk := b.bucketLocked(now)
+		bk.requests++
+
+		if success {
+			b.consecutive = 0
+			break
+		}
+
+		bk.failures++
+		b.consecutive++
+
+		requests, failures := b.countLocked(now)
+		if b.consecutive >= maxConsecutive || (requests >= minRequests && float64(failures) >= float64(requests)*maxErrorRate) {
+			b.openLocked(now)
+		}
+	case HalfOpen:
+		b.probing = false
+
+		if !success {
+			b.openLocked(now)
+		} else if b.probes++; b.probes >= probeSuccesses {
+			b.state = Closed
+			b.buckets = [windowBuckets]bucket{}
+			b.consecutive = 0
+		}
+	}
+	// Outcomes of requests sent before the breaker opened don't matter.
+
+	return b.state, b.state != previous
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stateLocked(util.Now())
+}
+
+// stateLocked moves an open breaker to half-open once it was open long enough.
+// stateLocked assumes b.mu is already locked.
+func (b *Breaker) stateLocked(now time.Time) State {
+	if b.state == Open && now.Sub(b.openedAt) >= openFor {
+		b.state = HalfOpen
+		b.probing = false
+		b.probes = 0
+	}
+	return b.state
+}
+
+// openLocked assumes b.mu is already locked.
+func (b *Breaker) openLocked(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+	b.probing = false
+}
+
+// bucketLocked returns the bucket for now, it's reset if it was last used in an older window.
+// bucketLocked assumes b.mu is already locked.
+func (b *Breaker) bucketLocked(now time.Time) *bucket {
+	start := now.Truncate(bucketSize)
+	bk := &b.buckets[(start.UnixNano()/int64(bucketSize))%windowBuckets]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+// countLocked returns the number of requests and failures in the window.
+// countLocked assumes b.mu is already locked.
+func (b *Breaker) countLocked(now time.Time) (requests int, failures int) {
+	oldest := now.Add(-window)
+	for _, bk := range b.buckets {
+		if bk.start.After(oldest) {
+			requests += bk.requests
+			failures += bk.failures
+		}
+	}
+	return
+}
+
+// MarshalJSON is used to show the breaker on /debug.
+func (b *Breaker) MarshalJSON() ([]byte, error) {
+	now := util.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	requests, failures := b.countLocked(now)
+	v := map[string]interface{}{
+		"state":                b.stateLocked(now).String(),
+		"requests":             requests,
+		"failures":             failures,
+		"consecutive_failures": b.consecutive,
+	}
+	if b.state != Closed {
+		v["opened_at"] = b.openedAt
+	}
+
+	return json.Marshal(v)
+}
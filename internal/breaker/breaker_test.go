@@ -0,0 +1,85 @@
+package breaker_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ip-api/proxy/internal/breaker"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+func TestBreaker(t *testing.T) {
+	currentTime := time.Now()
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	record := func(b *breaker.Breaker, success bool, expected breaker.State) {
+		t.Helper()
+
+		if !b.Allow() {
+			t.Fatalf("expected a request to be allowed in %s", b.State())
+		}
+		if state, _ := b.Record(success); state != expected {
+			t.Fatalf("expected %s got %s", expected, state)
+		}
+	}
+
+	// Consecutive failures open the breaker.
+	b := breaker.New()
+	for i := 0; i < 4; i++ {
+		record(b, false, breaker.Closed)
+	}
+	record(b, false, breaker.Open)
+
+	if b.Allow() {
+		t.Error("expected an open breaker to not allow requests")
+	}
+
+	// After a while one probe at a time is allowed.
+	currentTime = currentTime.Add(time.Second * 30)
+	if state := b.State(); state != breaker.HalfOpen {
+		t.Errorf("expected half-open got %s", state)
+	}
+	if !b.Allow() || b.Allow() {
+		t.Error("expected exactly one probe to be allowed")
+	}
+	b.Record(true)
+
+	// A failed probe opens it again.
+	record(b, false, breaker.Open)
+
+	currentTime = currentTime.Add(time.Second * 30)
+	record(b, true, breaker.HalfOpen)
+	record(b, true, breaker.HalfOpen)
+	record(b, true, breaker.Closed)
+
+	// Spaced out failures open the breaker once they are half of the requests in the window.
+	b = breaker.New()
+	for i := 0; i < 9; i++ {
+		currentTime = currentTime.Add(time.Second * 5)
+		record(b, i%2 == 0, breaker.Closed)
+	}
+	currentTime = currentTime.Add(time.Second * 5)
+	record(b, false, breaker.Open)
+
+	// Failures which left the window don't count.
+	b = breaker.New()
+	for i := 0; i < 20; i++ {
+		currentTime = currentTime.Add(time.Second * 10)
+		record(b, i%2 == 0, breaker.Closed)
+	}
+
+	buf, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), `"state":"closed"`) {
+		t.Errorf("expected the state in %s", buf)
+	}
+}
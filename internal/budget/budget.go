@@ -0,0 +1,281 @@
+// Package budget counts the lookups sent upstream per day and per month and enforces limits on them.
+package budget
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// State of the budget, each state includes the previous one.
+type State int
+
+const (
+	// OK means no limit was reached.
+	OK State = iota
+	// Soft means a soft limit was reached, stale entries should be preferred over fetching them.
+	Soft
+	// Hard means a hard limit was reached, nothing should be fetched upstream.
+	Hard
+)
+
+func (s State) String() string {
+	switch s {
+	case Soft:
+		return "soft"
+	case Hard:
+		return "hard"
+	default:
+		return "ok"
+	}
+}
+
+// ErrExhausted is returned by Allow when a hard limit was reached.
+var ErrExhausted = errors.New("upstream budget exhausted")
+
+// How often the counters are saved.
+const saveInterval = time.Minute
+
+var (
+	metricUsed  = metrics.NewGaugeVec("ipapi_proxy_budget_used", "Number of lookups sent upstream in the current period.", "period")
+	metricLimit = metrics.NewGaugeVec("ipapi_proxy_budget_limit", "Upstream lookup limits per period, 0 is unlimited.", "period", "limit")
+	metricState = metrics.NewGauge("ipapi_proxy_budget_state", "State of the upstream budget: 0 ok, 1 soft limit reached, 2 hard limit reached.")
+)
+
+// counters is also the format of the budget file.
+type counters struct {
+	Day     string `json:"day"`   // 2006-01-02 in UTC.
+	Month   string `json:"month"` // 2006-01 in UTC.
+	Daily   int64  `json:"daily"`
+	Monthly int64  `json:"monthly"`
+}
+
+type limits struct {
+	dailySoft, dailyHard     int64
+	monthlySoft, monthlyHard int64
+}
+
+// Budget counts upstream lookups. A nil Budget counts nothing and allows everything.
+type Budget struct {
+	logger zerolog.Logger
+	path   string
+
+	mu     sync.Mutex
+	c      counters
+	limits limits
+	state  State
+	dirty  bool
+}
+
+// New returns a Budget with the limits in cfg. The counters are restored from BUDGET_FILE
+// if it exists and are saved to it every minute, if it is set.
+func New(logger zerolog.Logger, cfg config.Config) (*Budget, error) {
+	b := &Budget{
+		logger: logger,
+		path:   cfg.BudgetFile,
+	}
+
+	if b.path != "" {
+		buf, err := ioutil.ReadFile(b.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if err == nil {
+			if err := json.Unmarshal(buf, &b.c); err != nil {
+				return nil, fmt.Errorf("%s: %w", b.path, err)
+			}
+		}
+
+		go func() {
+			for {
+				time.Sleep(saveInterval)
+				if err := b.Save(); err != nil {
+					logger.Error().Err(err).Str("file", b.path).Msg("failed to save budget")
+				}
+			}
+		}()
+	}
+
+	b.Reload(cfg)
+
+	return b, nil
+}
+
+// Reload applies the BUDGET_* limits in cfg.
+func (b *Budget) Reload(cfg config.Config) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limits = limits{
+		dailySoft:   int64(cfg.BudgetDailySoft),
+		dailyHard:   int64(cfg.BudgetDailyHard),
+		monthlySoft: int64(cfg.BudgetMonthlySoft),
+		monthlyHard: int64(cfg.BudgetMonthlyHard),
+	}
+
+	metricLimit.With("day", "soft").Set(b.limits.dailySoft)
+	metricLimit.With("day", "hard").Set(b.limits.dailyHard)
+	metricLimit.With("month", "soft").Set(b.limits.monthlySoft)
+	metricLimit.With("month", "hard").Set(b.limits.monthlyHard)
+
+	b.updateLocked()
+}
+
+// updateLocked resets the counters when a new day or month started and updates the state.
+// updateLocked assumes b.mu is already locked.
+func (b *Budget) updateLocked() {
+	now := util.Now().UTC()
+
+	if day := now.Format("2006-01-02"); b.c.Day != day {
+		b.c.Day = day
+		b.c.Daily = 0
+		b.dirty = true
+	}
+	if month := now.Format("2006-01"); b.c.Month != month {
+		b.c.Month = month
+		b.c.Monthly = 0
+		b.dirty = true
+	}
+
+	reached := func(used, limit int64) bool {
+		return limit > 0 && used >= limit
+	}
+
+	state := OK
+	if reached(b.c.Daily, b.limits.dailyHard) || reached(b.c.Monthly, b.limits.monthlyHard) {
+		state = Hard
+	} else if reached(b.c.Daily, b.limits.dailySoft) || reached(b.c.Monthly, b.limits.monthlySoft) {
+		state = Soft
+	}
+
+	if state != b.state {
+		event := b.logger.Info()
+		if state > b.state {
+			event = b.logger.Warn()
+		}
+		event.Str("state", state.String()).Int64("daily", b.c.Daily).Int64("monthly", b.c.Monthly).Msg("upstream budget state changed")
+		b.state = state
+	}
+
+	metricUsed.With("day").Set(b.c.Daily)
+	metricUsed.With("month").Set(b.c.Monthly)
+	metricState.Set(int64(b.state))
+}
+
+// State returns the current state of the budget.
+func (b *Budget) State() State {
+	if b == nil {
+		return OK
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.updateLocked()
+	return b.state
+}
+
+// Allow returns ErrExhausted if a hard limit was reached or n more lookups would go past one.
+func (b *Budget) Allow(n int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.updateLocked()
+
+	exceeds := func(used, limit int64) bool {
+		return limit > 0 && used+int64(n) > limit
+	}
+	if b.state == Hard || exceeds(b.c.Daily, b.limits.dailyHard) || exceeds(b.c.Monthly, b.limits.monthlyHard) {
+		return ErrExhausted
+	}
+	return nil
+}
+
+// Spend counts n lookups sent upstream.
+func (b *Budget) Spend(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.updateLocked()
+	b.c.Daily += int64(n)
+	b.c.Monthly += int64(n)
+	b.dirty = true
+	b.updateLocked()
+}
+
+// Save atomically writes the counters to BUDGET_FILE if they changed.
+func (b *Budget) Save() error {
+	if b == nil || b.path == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	buf, err := json.Marshal(b.c)
+	b.dirty = false
+	b.mu.Unlock()
+
+	if err == nil {
+		err = util.WriteFile(b.path, buf)
+	}
+	if err != nil {
+		// Try again next time.
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+	}
+
+	return err
+}
+
+// Debug returns the counters, limits and state.
+func (b *Budget) Debug() interface{} {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.updateLocked()
+
+	return map[string]interface{}{
+		"state": b.state.String(),
+		"day": map[string]interface{}{
+			"date": b.c.Day,
+			"used": b.c.Daily,
+			"soft": b.limits.dailySoft,
+			"hard": b.limits.dailyHard,
+		},
+		"month": map[string]interface{}{
+			"date": b.c.Month,
+			"used": b.c.Monthly,
+			"soft": b.limits.monthlySoft,
+			"hard": b.limits.monthlyHard,
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package budget_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/budget"
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+func TestNil(t *testing.T) {
+	var b *budget.Budget
+
+	b.Spend(10)
+	if err := b.Allow(100); err != nil {
+		t.Errorf("expected nil budget to allow everything got %v", err)
+	}
+	if err := b.Save(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	currentTime := time.Date(2020, 1, 30, 12, 0, 0, 0, time.UTC)
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	dir, err := ioutil.TempDir("", "budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.Default()
+	cfg.BudgetFile = filepath.Join(dir, "budget.json")
+	cfg.BudgetDailySoft = 5
+	cfg.BudgetDailyHard = 10
+	cfg.BudgetMonthlyHard = 15
+
+	b, err := budget.New(zerolog.Nop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		wait     time.Duration
+		spend    int
+		expected budget.State
+	}{
+		{0, 4, budget.OK},
+		{0, 1, budget.Soft},
+		{0, 5, budget.Hard},
+		// A new day resets the daily counter, but not the monthly one.
+		{time.Hour * 12, 4, budget.OK},
+		{0, 1, budget.Hard},
+		// A new month resets both.
+		{time.Hour * 24, 0, budget.OK},
+		{0, 5, budget.Soft},
+	}
+
+	for i, test := range tests {
+		currentTime = currentTime.Add(test.wait)
+		b.Spend(test.spend)
+
+		if state := b.State(); state != test.expected {
+			t.Errorf("%d: expected %s got %s", i, test.expected, state)
+		}
+		if err := b.Allow(0); (err == budget.ErrExhausted) != (test.expected == budget.Hard) {
+			t.Errorf("%d: unexpected Allow error %v", i, err)
+		}
+	}
+
+	// 5 lookups are left today, a batch with more would go past the hard limit.
+	if err := b.Allow(5); err != nil {
+		t.Errorf("expected 5 lookups to be allowed got %v", err)
+	}
+	if err := b.Allow(6); err != budget.ErrExhausted {
+		t.Errorf("expected 6 lookups to be exhausted got %v", err)
+	}
+
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters are restored.
+	restored, err := budget.New(zerolog.Nop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := restored.State(); state != budget.Soft {
+		t.Errorf("expected the restored budget to be soft got %s", state)
+	}
+
+	// Limits can be changed.
+	cfg.BudgetDailyHard = 5
+	restored.Reload(cfg)
+	if state := restored.State(); state != budget.Hard {
+		t.Errorf("expected the reloaded budget to be hard got %s", state)
+	}
+}
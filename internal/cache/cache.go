@@ -2,11 +2,22 @@ package cache
 
 import (
 	"container/list"
+	"time"
 
+	"github.com/ip-api/proxy/internal/metrics"
 	"github.com/ip-api/proxy/internal/structs"
 	"github.com/ip-api/proxy/internal/util"
 )
 
+var (
+	metricHits      = metrics.NewCounter("ipapi_proxy_cache_hits_total", "Number of cache lookups that returned an entry.")
+	metricStaleHits = metrics.NewCounter("ipapi_proxy_cache_stale_hits_total", "Number of cache lookups that returned an expired entry within the allowed staleness.")
+	metricMisses    = metrics.NewCounter("ipapi_proxy_cache_misses_total", "Number of cache lookups that didn't find an entry or found an expired one.")
+	metricEvictions = metrics.NewCounter("ipapi_proxy_cache_evictions_total", "Number of entries evicted because the cache was full.")
+	metricBytes     = metrics.NewGauge("ipapi_proxy_cache_bytes", "Current size of the cache in bytes.")
+	metricEntries   = metrics.NewGauge("ipapi_proxy_cache_entries", "Current number of entries in the cache.")
+)
+
 // Based on https://raw.githubusercontent.com/hashicorp/golang-lru/master/simplelru/lru.go
 type Cache struct {
 	evictList *list.List
@@ -41,7 +52,10 @@ func (c *Cache) addSize(size int) {
 	c.sizeBytes += size
 	for c.sizeBytes > c.maxBytes {
 		c.removeOldest()
+		metricEvictions.Inc()
 	}
+	metricBytes.Set(int64(c.sizeBytes))
+	metricEntries.Set(int64(len(c.items)))
 }
 
 // Add adds a value to the cache.  Returns true if an eviction occurred.
@@ -54,6 +68,7 @@ func (c *Cache) Add(key string, value *structs.CacheEntry) {
 		entr := ent.Value.(*entry)
 		entr.value = value
 		c.sizeBytes -= entr.size
+		entr.size = size
 		c.addSize(size)
 		return
 	}
@@ -68,16 +83,43 @@ func (c *Cache) Add(key string, value *structs.CacheEntry) {
 
 // Get looks up a key's value from the cache.
 func (c *Cache) Get(key string) *structs.CacheEntry {
+	e, _ := c.GetStale(key, 0)
+	return e
+}
+
+// GetStale looks up a key's value from the cache and also returns
+// entries which expired less than maxStale ago.
+// The returned bool is true if the entry has expired.
+func (c *Cache) GetStale(key string, maxStale time.Duration) (*structs.CacheEntry, bool) {
 	if ent, ok := c.items[key]; ok {
 		if ent.Value.(*entry) == nil {
-			return nil
+			metricMisses.Inc()
+			return nil, false
 		}
 		e := ent.Value.(*entry).value
-		if e.Expires.Before(util.Now()) {
-			return nil
+		now := util.Now()
+		stale := e.Expires.Before(now)
+		if stale && e.Expires.Add(maxStale).Before(now) {
+			metricMisses.Inc()
+			return nil, false
 		}
 		c.evictList.MoveToFront(ent)
-		return e
+		if stale {
+			metricStaleHits.Inc()
+		} else {
+			metricHits.Inc()
+		}
+		return e, stale
+	}
+	metricMisses.Inc()
+	return nil, false
+}
+
+// Peek returns the entry for key no matter when it expired,
+// without marking it as recently used or counting it in the metrics.
+func (c *Cache) Peek(key string) *structs.CacheEntry {
+	if ent, ok := c.items[key]; ok {
+		return ent.Value.(*entry).value
 	}
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"math/rand"
 	"strconv"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/ip-api/proxy/internal/cache"
@@ -38,7 +39,7 @@ func TestCache(t *testing.T) {
 	}
 
 	size = c.Size()
-	expectedSize = 99590
+	expectedSize = 99929
 	if size != expectedSize {
 		t.Errorf("expected %d got %d", expectedSize, size)
 	}
@@ -47,3 +48,25 @@ func TestCache(t *testing.T) {
 		t.Error(`entry "0" should be evicted`)
 	}
 }
+
+func TestPeek(t *testing.T) {
+	c := cache.New(100000)
+
+	// Peek also returns expired entries.
+	c.Add("a", &structs.CacheEntry{IP: "1.1.1.1", Expires: time.Now().Add(-time.Hour)})
+	c.Add("b", &structs.CacheEntry{IP: "2.2.2.2", Expires: time.Now().Add(time.Hour)})
+	if e := c.Peek("a"); e == nil || e.IP != "1.1.1.1" {
+		t.Errorf("expected the expired entry got %v", e)
+	}
+	if c.Peek("c") != nil {
+		t.Error("expected no entry")
+	}
+
+	// Peeking doesn't mark "a" as recently used, so it is evicted first.
+	for i := 0; c.Peek("a") != nil; i++ {
+		if c.Peek("b") == nil {
+			t.Fatal(`expected "a" to be evicted before "b"`)
+		}
+		c.Add(strconv.Itoa(i), &structs.CacheEntry{IP: strconv.Itoa(i)})
+	}
+}
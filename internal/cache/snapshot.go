@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// A snapshot file starts with snapshotMagic, followed by one JSON encoded
+// snapshotEntry per line and ends with a trailer containing the number of
+// entries and the CRC32 of everything before the trailer.
+const snapshotMagic = "ip-api-proxy cache v1\n"
+
+// ErrCorruptSnapshot is returned when a snapshot file is truncated or its checksum doesn't match.
+var ErrCorruptSnapshot = errors.New("corrupt cache snapshot")
+
+type snapshotEntry struct {
+	IP       string           `json:"ip"`
+	Lang     string           `json:"lang"`
+	Fields   field.Fields     `json:"fields"`
+	Expires  time.Time        `json:"expires"`
+	Response structs.Response `json:"response"`
+
+	Expiries []structs.FieldsExpiry `json:"expiries,omitempty"`
+	Source   string                 `json:"source,omitempty"`
+}
+
+// Entries returns all entries which expired less than maxStale ago, least recently used first.
+func (c *Cache) Entries(maxStale time.Duration) []*structs.CacheEntry {
+	now := util.Now()
+	entries := make([]*structs.CacheEntry, 0, len(c.items))
+
+	for e := c.evictList.Back(); e != nil; e = e.Prev() {
+		v := e.Value.(*entry).value
+		if v.Expires.Add(maxStale).After(now) {
+			entries = append(entries, v)
+		}
+	}
+
+	return entries
+}
+
+// WriteSnapshot atomically writes entries to path.
+func WriteSnapshot(path string, entries []*structs.CacheEntry) error {
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, entries); err != nil {
+		return err
+	}
+
+	return util.WriteFile(path, buf.Bytes())
+}
+
+func writeSnapshot(w io.Writer, entries []*structs.CacheEntry) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(bw, crc)
+
+	if _, err := io.WriteString(out, snapshotMagic); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		line, err := json.Marshal(snapshotEntry{
+			IP:       e.IP,
+			Lang:     e.Lang,
+			Fields:   e.Fields,
+			Expires:  e.Expires,
+			Response: e.Response,
+			Expiries: e.Expiries,
+			Source:   e.Source,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(bw, "end %d %08x\n", len(entries), crc.Sum32()); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot and returns all entries which expired less than maxStale ago.
+// If the file is truncated or corrupt ErrCorruptSnapshot is returned and no entries.
+func ReadSnapshot(path string, maxStale time.Duration) ([]*structs.CacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readSnapshot(f, maxStale)
+}
+
+func readSnapshot(r io.Reader, maxStale time.Duration) ([]*structs.CacheEntry, error) {
+	br := bufio.NewReader(r)
+	crc := crc32.NewIEEE()
+	now := util.Now()
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, ErrCorruptSnapshot
+	}
+	crc.Write(magic)
+
+	var entries []*structs.CacheEntry
+	count := 0
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// Every valid snapshot ends with a newline terminated trailer.
+			return nil, ErrCorruptSnapshot
+		}
+
+		if bytes.HasPrefix(line, []byte("end ")) {
+			var n int
+			var sum uint32
+			if _, err := fmt.Sscanf(string(line), "end %d %08x\n", &n, &sum); err != nil {
+				return nil, ErrCorruptSnapshot
+			}
+			if n != count || sum != crc.Sum32() {
+				return nil, ErrCorruptSnapshot
+			}
+			break
+		}
+
+		crc.Write(line)
+		count++
+
+		var e snapshotEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, ErrCorruptSnapshot
+		}
+
+		if !e.Expires.Add(maxStale).After(now) {
+			continue
+		}
+
+		entries = append(entries, &structs.CacheEntry{
+			IP:       e.IP,
+			Lang:     e.Lang,
+			Fields:   e.Fields,
+			Expires:  e.Expires,
+			Response: e.Response,
+			Expiries: e.Expiries,
+			Source:   e.Source,
+		})
+	}
+
+	return entries, nil
+}
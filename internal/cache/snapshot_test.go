@@ -0,0 +1,133 @@
+package cache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ip-api/proxy/internal/cache"
+	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache")
+
+	c := cache.New(100000)
+	c.Add("1.1.1.1en", &structs.CacheEntry{
+		IP:       "1.1.1.1",
+		Lang:     "en",
+		Fields:   17,
+		Expires:  util.Now().Add(time.Hour),
+		Response: structs.ErrorResponse("", ""),
+	})
+	c.Add("2.2.2.2en", &structs.CacheEntry{
+		IP:       "2.2.2.2",
+		Lang:     "en",
+		Expires:  util.Now().Add(-time.Hour),
+		Response: structs.ErrorResponse("success", "expired"),
+	})
+	c.Add("3.3.3.3en", &structs.CacheEntry{
+		IP:       "3.3.3.3",
+		Lang:     "en",
+		Expires:  util.Now().Add(-time.Minute),
+		Response: structs.ErrorResponse("success", "stale"),
+	})
+
+	if err := cache.WriteSnapshot(path, c.Entries(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := cache.ReadSnapshot(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.IP != "1.1.1.1" || e.Lang != "en" || e.Fields != 17 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	// Empty strings must survive the round trip as they are part of the response.
+	if e.Response.Status == nil || *e.Response.Status != "" {
+		t.Errorf("expected empty status got %v", e.Response.Status)
+	}
+
+	// Expired entries which can still be served stale are kept.
+	if err := cache.WriteSnapshot(path, c.Entries(time.Minute*10)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = cache.ReadSnapshot(path, time.Minute*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].IP != "1.1.1.1" || entries[1].IP != "3.3.3.3" {
+		t.Fatalf("expected 1.1.1.1 and 3.3.3.3 got %+v", entries)
+	}
+
+	// The stale window is checked again when reading.
+	entries, err = cache.ReadSnapshot(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry got %d", len(entries))
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache")
+
+	c := cache.New(100000)
+	c.Add("1.1.1.1en", &structs.CacheEntry{
+		IP:       "1.1.1.1",
+		Lang:     "en",
+		Expires:  util.Now().Add(time.Hour),
+		Response: structs.ErrorResponse("success", ""),
+	})
+
+	if err := cache.WriteSnapshot(path, c.Entries(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, corrupt := range map[string][]byte{
+		"truncated": data[:len(data)-10],
+		"flipped":   append(append([]byte{}, data[:30]...), append([]byte{data[30] ^ 1}, data[31:]...)...),
+		"empty":     {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, corrupt, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := cache.ReadSnapshot(path, 0); err != cache.ErrCorruptSnapshot {
+				t.Errorf("expected %v got %v", cache.ErrCorruptSnapshot, err)
+			}
+		})
+	}
+}
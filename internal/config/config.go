@@ -0,0 +1,404 @@
+// Package config loads the settings of the proxy from a config file and environment variables.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config contains all settings of the proxy.
+//
+// Every setting has an environment variable, the env tag. In the config file the same
+// setting uses the lowercase name, for example cache_ttl for CACHE_TTL.
+// Environment variables override the config file.
+//
+// Settings with the live tag are applied without a restart when the config is reloaded.
+type Config struct {
+	ConfigFile      string        `env:"CONFIG_FILE"`
+	IPAPIKey        string        `env:"IP_API_KEY" live:"true"`
+	Listen          string        `env:"LISTEN"`
+	TrustedProxies  []*net.IPNet  `env:"TRUSTED_PROXIES"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	TenantsFile     string        `env:"TENANTS_FILE"`
+
+	RateLimitHits    int `env:"RATE_LIMIT_HITS"`
+	RateLimitFetches int `env:"RATE_LIMIT_FETCHES"`
+
+	BudgetFile        string `env:"BUDGET_FILE"`
+	BudgetDailySoft   int    `env:"BUDGET_DAILY_SOFT" live:"true"`
+	BudgetDailyHard   int    `env:"BUDGET_DAILY_HARD" live:"true"`
+	BudgetMonthlySoft int    `env:"BUDGET_MONTHLY_SOFT" live:"true"`
+	BudgetMonthlyHard int    `env:"BUDGET_MONTHLY_HARD" live:"true"`
+
+	Backend     string        `env:"BACKEND"`
+	MMDBFile    []string      `env:"MMDB_FILE"`
+	FallbackTTL time.Duration `env:"FALLBACK_TTL"`
+
+	CacheTTL                  time.Duration `env:"CACHE_TTL" live:"true"`
+	CacheStaleWhileRevalidate time.Duration `env:"CACHE_STALE_WHILE_REVALIDATE"`
+	CacheStaleIfError         time.Duration `env:"CACHE_STALE_IF_ERROR"`
+	CacheSize                 int           `env:"CACHE_SIZE"`
+	CacheFile                 string        `env:"CACHE_FILE"`
+	CacheSaveInterval         time.Duration `env:"CACHE_SAVE_INTERVAL"`
+
+	Retries         int           `env:"RETRIES" live:"true"`
+	RetryBackoff    time.Duration `env:"RETRY_BACKOFF" live:"true"`
+	RetryDeadline   time.Duration `env:"RETRY_DEADLINE" live:"true"`
+	HedgePercentile int           `env:"HEDGE_PERCENTILE" live:"true"`
+	PopsURL         string        `env:"POPS_URL"`
+	PopsStatic      []string      `env:"POPS_STATIC"`
+	PopsPin         []string      `env:"POPS_PIN"`
+	PopsExclude     []string      `env:"POPS_EXCLUDE"`
+	PopsFile        string        `env:"POPS_FILE"`
+	EgressProxy     string        `env:"EGRESS_PROXY"`
+	Balance         string        `env:"BALANCE" live:"true"`
+	BalancePops     int           `env:"BALANCE_POPS" live:"true"`
+	PopsRefresh     time.Duration `env:"POPS_REFRESH" live:"true"`
+	BatchDelay      time.Duration `env:"BATCH_DELAY" live:"true"`
+
+	LogOutput string `env:"LOG_OUTPUT"`
+	LogLevel  string `env:"LOG_LEVEL" live:"true"`
+
+	ReverseWorkers  int      `env:"REVERSE_WORKERS"`
+	ReversePreferGo bool     `env:"REVERSE_PREFERGO"`
+	ResolveServers  []string `env:"RESOLVE_SERVERS"`
+
+	OtelEndpoint       string   `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OtelTracesEndpoint string   `env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	OtelHeaders        []string `env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	OtelSamplerArg     float64  `env:"OTEL_TRACES_SAMPLER_ARG"`
+	OtelServiceName    string   `env:"OTEL_SERVICE_NAME"`
+}
+
+// Default returns the config used when nothing is set.
+func Default() Config {
+	return Config{
+		Listen:          "127.0.0.1:8080",
+		ShutdownTimeout: time.Second * 10,
+
+		Backend:     "ip-api",
+		FallbackTTL: time.Minute * 5,
+
+		CacheTTL:          time.Hour * 24,
+		CacheSize:         1024 * 1024 * 1024, // 1GB
+		CacheSaveInterval: time.Minute * 10,
+
+		Retries:       4,
+		RetryBackoff:  time.Millisecond * 100,
+		RetryDeadline: time.Second * 10,
+		PopsURL:       "https://d2e7s0viy93a0y.cloudfront.net/pops.json",
+		Balance:       "best",
+		BalancePops:   3,
+		PopsRefresh:   time.Hour,
+		BatchDelay:    time.Millisecond * 10,
+
+		ReverseWorkers:  10,
+		ReversePreferGo: true,
+
+		OtelSamplerArg:  1,
+		OtelServiceName: "ip-api-proxy",
+	}
+}
+
+// Load returns the default config with the settings in the file at CONFIG_FILE, if it is set,
+// and the environment variables applied. The config is validated.
+func Load() (Config, error) {
+	c := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+
+		values, err := parseFile(string(buf))
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+
+		for key, value := range values {
+			if strings.ToUpper(key) == "CONFIG_FILE" {
+				return c, fmt.Errorf("%s: CONFIG_FILE can only be set as an environment variable", path)
+			}
+			if err := c.set(strings.ToUpper(key), value); err != nil {
+				return c, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	for _, name := range Names() {
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			if err := c.set(name, v); err != nil {
+				return c, err
+			}
+		}
+	}
+
+	return c, c.Validate()
+}
+
+// Names returns the environment variable names of all settings.
+func Names() []string {
+	t := reflect.TypeOf(Config{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Tag.Get("env"))
+	}
+	return names
+}
+
+// set sets the setting with the environment variable name to value, which is a string or,
+// for arrays in the config file, a []string. Lists given as a string are comma separated.
+func (c *Config) set(name string, value interface{}) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("env") != name {
+			continue
+		}
+
+		f := v.Field(i)
+
+		elems, isArray := value.([]string)
+		if isArray && f.Kind() != reflect.Slice {
+			return fmt.Errorf("invalid %s: can't be an array", name)
+		}
+		s, _ := value.(string)
+
+		switch f.Interface().(type) {
+		case string:
+			f.SetString(s)
+		case []string:
+			f.Set(reflect.ValueOf(list(s, elems, isArray)))
+		case []*net.IPNet:
+			var nets []*net.IPNet
+			for _, e := range list(s, elems, isArray) {
+				n, err := parseNetwork(e)
+				if err != nil {
+					return fmt.Errorf("invalid %s: %w", name, err)
+				}
+				nets = append(nets, n)
+			}
+			f.Set(reflect.ValueOf(nets))
+		case int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			f.SetInt(int64(n))
+		case float64:
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			f.SetFloat(n)
+		case bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			f.SetBool(b)
+		case time.Duration:
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			f.SetInt(int64(d))
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown setting %q", strings.ToLower(name))
+}
+
+// list returns the non-empty elements of the array elems, or of the comma separated s if it isn't an array.
+func list(s string, elems []string, isArray bool) []string {
+	if !isArray {
+		elems = strings.Split(s, ",")
+	}
+
+	var list []string
+	for _, e := range elems {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// parseNetwork parses a CIDR, or an IP which is returned as a network with only that IP.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: s}
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Validate returns an error for the first invalid setting.
+func (c Config) Validate() error {
+	switch c.Backend {
+	case "ip-api", "mmdb", "ip-api+mmdb":
+	default:
+		return fmt.Errorf("invalid BACKEND %q", c.Backend)
+	}
+	if strings.Contains(c.Backend, "ip-api") && c.IPAPIKey == "" {
+		return fmt.Errorf("IP_API_KEY is required for BACKEND %q", c.Backend)
+	}
+	if strings.Contains(c.Backend, "mmdb") && len(c.MMDBFile) == 0 {
+		return fmt.Errorf("MMDB_FILE is required for BACKEND %q", c.Backend)
+	}
+
+	if c.Listen == "" {
+		return fmt.Errorf("LISTEN is required")
+	}
+
+	switch c.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid LOG_LEVEL %q", c.LogLevel)
+	}
+	switch c.LogOutput {
+	case "", "console":
+	default:
+		return fmt.Errorf("invalid LOG_OUTPUT %q", c.LogOutput)
+	}
+
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"FALLBACK_TTL", c.FallbackTTL},
+		{"CACHE_TTL", c.CacheTTL},
+		{"CACHE_SAVE_INTERVAL", c.CacheSaveInterval},
+		{"RETRY_BACKOFF", c.RetryBackoff},
+		{"RETRY_DEADLINE", c.RetryDeadline},
+		{"POPS_REFRESH", c.PopsRefresh},
+		{"BATCH_DELAY", c.BatchDelay},
+	} {
+		if d.d <= 0 {
+			return fmt.Errorf("%s must be positive", d.name)
+		}
+	}
+	if c.CacheStaleWhileRevalidate < 0 || c.CacheStaleIfError < 0 {
+		return fmt.Errorf("CACHE_STALE_WHILE_REVALIDATE and CACHE_STALE_IF_ERROR can't be negative")
+	}
+
+	if c.Retries < 1 {
+		return fmt.Errorf("RETRIES must be at least 1")
+	}
+	if c.HedgePercentile < 0 || c.HedgePercentile > 99 {
+		return fmt.Errorf("HEDGE_PERCENTILE must be between 0 and 99")
+	}
+	for _, p := range c.PopsStatic {
+		ip := p
+		if i := strings.LastIndexByte(p, '/'); i >= 0 {
+			ip = p[i+1:]
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid POPS_STATIC entry %q, expected pop/ip or ip", p)
+		}
+	}
+	if c.EgressProxy != "" {
+		// The URL isn't part of the error, it can contain a password.
+		if u, err := url.Parse(c.EgressProxy); err != nil || (u.Scheme != "http" && u.Scheme != "socks5") || u.Host == "" {
+			return fmt.Errorf("invalid EGRESS_PROXY, expected http://[user:password@]host[:port] or socks5://[user:password@]host[:port]")
+		}
+	}
+	switch c.Balance {
+	case "best", "weighted", "least":
+	default:
+		return fmt.Errorf("invalid BALANCE %q", c.Balance)
+	}
+	if c.BalancePops < 1 {
+		return fmt.Errorf("BALANCE_POPS must be at least 1")
+	}
+	if c.RateLimitHits < 0 || c.RateLimitFetches < 0 {
+		return fmt.Errorf("RATE_LIMIT_HITS and RATE_LIMIT_FETCHES can't be negative")
+	}
+	for _, b := range []struct {
+		period     string
+		soft, hard int
+	}{
+		{"DAILY", c.BudgetDailySoft, c.BudgetDailyHard},
+		{"MONTHLY", c.BudgetMonthlySoft, c.BudgetMonthlyHard},
+	} {
+		if b.soft < 0 || b.hard < 0 {
+			return fmt.Errorf("BUDGET_%s_SOFT and BUDGET_%s_HARD can't be negative", b.period, b.period)
+		}
+		if b.soft > 0 && b.hard > 0 && b.soft > b.hard {
+			return fmt.Errorf("BUDGET_%s_SOFT can't be more than BUDGET_%s_HARD", b.period, b.period)
+		}
+	}
+	if c.CacheSize < 1 {
+		return fmt.Errorf("CACHE_SIZE must be positive")
+	}
+	if c.ReverseWorkers < 1 {
+		return fmt.Errorf("REVERSE_WORKERS must be at least 1")
+	}
+	if c.OtelSamplerArg < 0 || c.OtelSamplerArg > 1 {
+		return fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1")
+	}
+	for _, h := range c.OtelHeaders {
+		if kv := strings.SplitN(h, "=", 2); len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q, expected key=value", h)
+		}
+	}
+
+	return nil
+}
+
+// Changes returns the names of the settings that differ between c and n,
+// split into the ones that can be applied live and the ones that need a restart.
+func (c Config) Changes(n Config) (live []string, restart []string) {
+	a, b := reflect.ValueOf(c), reflect.ValueOf(n)
+	t := a.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+
+		if t.Field(i).Tag.Get("live") == "true" {
+			live = append(live, t.Field(i).Tag.Get("env"))
+		} else {
+			restart = append(restart, t.Field(i).Tag.Get("env"))
+		}
+	}
+
+	return live, restart
+}
+
+// WithLive returns c with the live settings of n.
+func (c Config) WithLive(n Config) Config {
+	a, b := reflect.ValueOf(&c).Elem(), reflect.ValueOf(n)
+	t := a.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("live") == "true" {
+			a.Field(i).Set(b.Field(i))
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseFile parses the subset of TOML used by config files: comments and key = value pairs on a
+// single line, where the key is a bare key and the value is a string, integer, float, boolean or
+// an array of strings. Tables, dotted or quoted keys, multi-line strings and arrays, inline tables,
+// special and hexadecimal numbers and dates are rejected.
+// Strings and numbers are returned in the format of the environment variables, arrays as []string.
+// See: https://toml.io/en/v1.0.0
+func parseFile(s string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	for i, line := range strings.Split(s, "\n") {
+		n := i + 1
+
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fmt.Errorf("line %d: tables are not supported", n)
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		if strings.ContainsAny(key, `."'`) {
+			return nil, fmt.Errorf("line %d: dotted and quoted keys are not supported", n)
+		}
+		if !isBareKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", n, key)
+		}
+
+		value, rest, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, fmt.Errorf("line %d: unexpected %q after value", n, rest)
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+func isBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue parses the value at the start of s and returns it and the rest of s.
+// The value is a string, or a []string for arrays.
+func parseValue(s string) (interface{}, string, error) {
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+
+	switch s[0] {
+	case '"', '\'':
+		return parseString(s)
+	case '{':
+		return nil, "", fmt.Errorf("inline tables are not supported")
+	case '[':
+		elems := []string{}
+		s = strings.TrimSpace(s[1:])
+		for {
+			if s == "" || s[0] == '#' {
+				return nil, "", fmt.Errorf("unterminated array, arrays have to be on a single line")
+			}
+			if s[0] == ']' {
+				return elems, s[1:], nil
+			}
+
+			e, rest, err := parseString(s)
+			if err != nil {
+				return nil, "", fmt.Errorf("arrays can only contain strings: %w", err)
+			}
+			elems = append(elems, e)
+
+			s = strings.TrimSpace(rest)
+			if s != "" && s[0] == ',' {
+				s = strings.TrimSpace(s[1:])
+			} else if s == "" || s[0] != ']' {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	// Numbers and booleans end at whitespace or a comment.
+	end := strings.IndexAny(s, " \t#")
+	if end < 0 {
+		end = len(s)
+	}
+	value := s[:end]
+
+	if value != "true" && value != "false" {
+		value = strings.ReplaceAll(value, "_", "")
+		if strings.Trim(value, "0123456789.eE+-") != "" {
+			return nil, "", fmt.Errorf("invalid value %q, strings must be quoted", s[:end])
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return nil, "", fmt.Errorf("invalid number %q", s[:end])
+		}
+	}
+
+	return value, s[end:], nil
+}
+
+// parseString parses the single-line basic or literal string at the start of s.
+func parseString(s string) (string, string, error) {
+	if s == "" || s[0] != '"' && s[0] != '\'' {
+		return "", "", fmt.Errorf("expected a string")
+	}
+	if strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''") {
+		return "", "", fmt.Errorf("multi-line strings are not supported")
+	}
+
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u', 'U':
+				size := 4
+				if s[i] == 'U' {
+					size = 8
+				}
+				if i+size >= len(s) {
+					return "", "", fmt.Errorf("unterminated string")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", "", fmt.Errorf("invalid escape \\%s", s[i:i+1+size])
+				}
+				b.WriteRune(rune(r))
+				i += size
+			default:
+				return "", "", fmt.Errorf("unsupported escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string")
+}
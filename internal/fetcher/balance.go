@@ -0,0 +1,97 @@
+package fetcher
+
+import (
+	"time"
+
+	"github.com/ip-api/proxy/internal/breaker"
+)
+
+// Balancing strategies, see BALANCE.
+const (
+	// balanceBest uses the best PoP.
+	balanceBest = "best"
+	// balanceWeighted spreads requests over the best BALANCE_POPS PoPs
+	// using a smooth weighted round-robin, weighted by their latency.
+	balanceWeighted = "weighted"
+	// balanceLeast uses the one of the best BALANCE_POPS PoPs with the fewest requests in flight.
+	balanceLeast = "least"
+)
+
+// pickLocked returns the server to send a request to, or nil if no server can be used.
+// Servers which are held back because their rate limit is exhausted are skipped.
+// The servers must be ranked.
+// pickLocked assumes f.mu is already locked.
+func (f *ipApi) pickLocked(exclude *server) *server {
+	now := time.Now()
+
+	if f.balance != balanceBest {
+		// The best BALANCE_POPS servers which aren't open. Pinned servers aren't mixed with others.
+		candidates := make([]*server, 0, f.balancePops)
+		for _, s := range f.servers {
+			if len(candidates) == f.balancePops || (len(candidates) > 0 && candidates[0].Pin > 0 && s.Pin == 0) {
+				break
+			}
+			if s != exclude && !s.held(now) && s.Breaker.State() != breaker.Open {
+				candidates = append(candidates, s)
+			}
+		}
+
+		for len(candidates) > 0 {
+			var i int
+			if f.balance == balanceWeighted {
+				i = weighted(candidates)
+			} else {
+				i = least(candidates)
+			}
+
+			// A half-open breaker only allows one request at a time.
+			if s := candidates[i]; s.Breaker.Allow() {
+				return s
+			}
+			candidates = append(candidates[:i], candidates[i+1:]...)
+		}
+	}
+
+	for _, s := range f.servers {
+		if s != exclude && !s.held(now) && s.Breaker.Allow() {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// weighted returns the index of the next server using a smooth weighted round-robin:
+// every server gets its weight added to its current weight, the one with the highest
+// current weight is used and gets the total weight subtracted.
+// A server's weight is the inverse of its score from rank, so twice as fast gets twice the requests.
+func weighted(servers []*server) int {
+	best := 0
+	total := 0.0
+
+	for i, s := range servers {
+		w := 1 / s.score
+		total += w
+		s.weight += w
+
+		if s.weight > servers[best].weight {
+			best = i
+		}
+	}
+
+	servers[best].weight -= total
+
+	return best
+}
+
+// least returns the index of the server with the fewest requests in flight.
+// Ties go to the best ranked server.
+func least(servers []*server) int {
+	best := 0
+	for i, s := range servers {
+		if s.Stats.inFlight() < servers[best].Stats.inFlight() {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,196 @@
+package fetcher
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ip-api/proxy/internal/breaker"
+	"github.com/ip-api/proxy/internal/config"
+)
+
+// newBalanceServers returns servers with the given latencies, ranked.
+func newBalanceServers(latencies ...time.Duration) []*server {
+	servers := make([]*server, 0, len(latencies))
+	for i, l := range latencies {
+		s := &server{Pop: fmt.Sprintf("pop%d", i+1), Stats: newStats(), Breaker: breaker.New()}
+		s.Stats.observe(l, true)
+		servers = append(servers, s)
+	}
+	rank(servers)
+	return servers
+}
+
+// picks returns how often every server is picked in n requests.
+func picks(f *ipApi, n int) map[*server]int {
+	counts := make(map[*server]int)
+	for i := 0; i < n; i++ {
+		counts[f.pickLocked(nil)]++
+	}
+	return counts
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	servers := newBalanceServers(time.Millisecond*10, time.Millisecond*20, time.Millisecond*40)
+	f := &ipApi{servers: servers, balance: balanceWeighted, balancePops: 3}
+
+	// Twice as fast gets twice the requests, exactly because the round-robin is smooth.
+	counts := picks(f, 700)
+	for i, expected := range []int{400, 200, 100} {
+		if c := counts[servers[i]]; c != expected {
+			t.Errorf("%s: expected %d requests got %d", servers[i].Pop, expected, c)
+		}
+	}
+
+	// The first requests are spread instead of all going to the best one first.
+	f = &ipApi{servers: newBalanceServers(time.Millisecond*10, time.Millisecond*10), balance: balanceWeighted, balancePops: 2}
+	if a, b := f.pickLocked(nil), f.pickLocked(nil); a == b {
+		t.Errorf("expected two servers with the same latency to alternate got %s twice", a.Pop)
+	}
+}
+
+func TestBalanceWeightedRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for run := 0; run < 20; run++ {
+		latencies := make([]time.Duration, 2+rnd.Intn(4))
+		for i := range latencies {
+			latencies[i] = time.Millisecond + time.Duration(rnd.Int63n(int64(time.Millisecond*200)))
+		}
+		servers := newBalanceServers(latencies...)
+		f := &ipApi{servers: servers, balance: balanceWeighted, balancePops: len(servers)}
+
+		total := 0.0
+		for _, s := range servers {
+			total += 1 / s.score
+		}
+
+		const n = 10000
+		counts := picks(f, n)
+		for _, s := range servers {
+			expected := n * (1 / s.score) / total
+			// Every server is at most one request behind or ahead of its share.
+			if c := float64(counts[s]); math.Abs(c-expected) > 1 {
+				t.Errorf("%d %v: expected %s to get %.1f requests got %.0f", run, latencies, s.Pop, expected, c)
+			}
+		}
+	}
+}
+
+func TestBalanceLeast(t *testing.T) {
+	servers := newBalanceServers(time.Millisecond*10, time.Millisecond*20, time.Millisecond*40)
+	f := &ipApi{servers: servers, balance: balanceLeast, balancePops: 3}
+
+	tests := []struct {
+		flight   []int
+		expected int
+	}{
+		// Ties go to the best ranked server.
+		{[]int{0, 0, 0}, 0},
+		{[]int{1, 1, 1}, 0},
+		{[]int{2, 1, 1}, 1},
+		{[]int{1, 1, 0}, 2},
+		{[]int{3, 2, 2}, 1},
+	}
+
+	for _, test := range tests {
+		for i, s := range servers {
+			s.Stats.flight = int64(test.flight[i])
+		}
+
+		if s := f.pickLocked(nil); s != servers[test.expected] {
+			t.Errorf("%v: expected %s got %s", test.flight, servers[test.expected].Pop, s.Pop)
+		}
+	}
+}
+
+func TestBalancePops(t *testing.T) {
+	for _, balance := range []string{balanceWeighted, balanceLeast} {
+		servers := newBalanceServers(time.Millisecond*10, time.Millisecond*10, time.Millisecond*10, time.Millisecond*10)
+		f := &ipApi{servers: servers, balance: balance, balancePops: 2}
+
+		// Requests in flight make least use all servers it may.
+		for _, s := range servers {
+			s.Stats.start()
+		}
+
+		for i := 0; i < 100; i++ {
+			s := f.pickLocked(nil)
+			if s != servers[0] && s != servers[1] {
+				t.Fatalf("%s: expected only the best 2 servers to be used got %s", balance, s.Pop)
+			}
+			s.Stats.start()
+		}
+
+		// A server with an open breaker is replaced by the next one.
+		for i := 0; i < 5; i++ {
+			servers[0].Breaker.Record(false)
+		}
+		counts := make([]int, len(servers))
+		for i := 0; i < 100; i++ {
+			s := f.pickLocked(nil)
+			for j := range servers {
+				if s == servers[j] {
+					counts[j]++
+				}
+			}
+			s.Stats.start()
+		}
+		if counts[0] > 0 || counts[1] == 0 || counts[2] == 0 || counts[3] > 0 {
+			t.Errorf("%s: expected the second and third server to be used got %v requests", balance, counts)
+		}
+	}
+}
+
+func TestBalancePinned(t *testing.T) {
+	servers := newBalanceServers(time.Millisecond*10, time.Millisecond*20, time.Millisecond*30)
+	servers[2].Pin = 1
+	rank(servers)
+	f := &ipApi{servers: servers, balance: balanceWeighted, balancePops: 3}
+
+	// Pinned servers aren't mixed with others.
+	if c := picks(f, 10)[servers[0]]; c != 10 {
+		t.Errorf("expected the pinned server to get all 10 requests got %d", c)
+	}
+}
+
+func TestHoldExhausted(t *testing.T) {
+	cfg := config.Default()
+	cfg.Retries = 1
+
+	// pop1 is ranked first, its response is fine but no requests are left.
+	exhausted := testPop{status: 200, header: map[string]string{"X-Rl": "0", "X-Ttl": "60"}}
+	other := testPop{status: 200}
+	f, start := newTestIPApi(t, cfg, &exhausted, &other)
+
+	for i, expected := range []string{"pop1", "pop2", "pop2"} {
+		pop, err := fetch(f, start, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pop != expected {
+			t.Errorf("%d: expected %s got %s", i, expected, pop)
+		}
+	}
+
+	for _, s := range f.servers {
+		if held := time.Until(time.Unix(0, atomic.LoadInt64(&s.heldUntil))); (s.Pop == "pop1") != (held > time.Second*59) {
+			t.Errorf("%s: expected to be held back for X-Ttl only if exhausted got %s", s.Pop, held)
+		}
+	}
+
+	// Once X-Ttl passed pop1 is used again.
+	servers := newBalanceServers(time.Millisecond*10, time.Millisecond*20)
+	f = &ipApi{servers: servers, balance: balanceBest}
+	servers[0].hold(time.Now().Add(time.Minute))
+	if s := f.pickLocked(nil); s != servers[1] {
+		t.Errorf("expected %s got %s", servers[1].Pop, s.Pop)
+	}
+	servers[0].hold(time.Now())
+	if s := f.pickLocked(nil); s != servers[0] {
+		t.Errorf("expected %s got %s", servers[0].Pop, s.Pop)
+	}
+}
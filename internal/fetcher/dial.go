@@ -0,0 +1,13 @@
+package fetcher
+
+import (
+	"crypto/tls"
+)
+
+// The host of all requests, PoPs are connected to by IP.
+const upstreamHost = "pro.ip-api.com"
+
+// upstreamTLSConfig is used for all TLS connections to ip-api.com.
+var upstreamTLSConfig = &tls.Config{
+	ServerName: upstreamHost,
+}
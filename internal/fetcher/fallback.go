@@ -0,0 +1,122 @@
+package fetcher
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/budget"
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/trace"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+var (
+	metricFallbacks = metrics.NewCounterVec("ipapi_proxy_fallback_total", "Number of batches answered by the fallback after the primary backend failed, by result.", "result")
+)
+
+type fallback struct {
+	logger zerolog.Logger
+
+	primary  Client
+	fallback Client
+	ttl      time.Duration
+
+	// 1 while the primary fails because its budget is exhausted, only accessed atomically.
+	exhausted int32
+}
+
+// NewFallback returns a Client which uses fallback when primary returns an error.
+// Entries from the fallback are only cached for FALLBACK_TTL so the primary is tried again soon.
+func NewFallback(logger zerolog.Logger, primary, secondary Client, cfg config.Config) (*fallback, error) {
+	return &fallback{
+		logger:   logger,
+		primary:  primary,
+		fallback: secondary,
+		ttl:      cfg.FallbackTTL,
+	}, nil
+}
+
+func (f *fallback) Reload(cfg config.Config) {
+	f.primary.Reload(cfg)
+	f.fallback.Reload(cfg)
+}
+
+func (f *fallback) PreferStale() bool {
+	return f.primary.PreferStale()
+}
+
+func (f *fallback) Debug() interface{} {
+	return map[string]interface{}{
+		"primary":  f.primary.Debug(),
+		"fallback": f.fallback.Debug(),
+	}
+}
+
+// Readiness reports problems only if neither the primary nor the fallback can fetch entries.
+func (f *fallback) Readiness() []string {
+	primary := f.primary.Readiness()
+	if primary == nil {
+		return nil
+	}
+
+	if fallback := f.fallback.Readiness(); fallback != nil {
+		return append(primary, fallback...)
+	}
+	return nil
+}
+
+func (f *fallback) Fetch(m map[string]*structs.CacheEntry, span *trace.Span) error {
+	// The primary can modify the fields, so save them for the fallback.
+	fields := make(map[string]field.Fields, len(m))
+	for key, entry := range m {
+		fields[key] = entry.Fields
+	}
+
+	err := f.primary.Fetch(m, span)
+	if !errors.Is(err, budget.ErrExhausted) {
+		atomic.StoreInt32(&f.exhausted, 0)
+	}
+	if err == nil {
+		return nil
+	}
+
+	// Every batch fails the same way until the budget resets, so that is only logged once.
+	if errors.Is(err, budget.ErrExhausted) && !atomic.CompareAndSwapInt32(&f.exhausted, 0, 1) {
+		f.logger.Debug().Err(err).Int("entries", len(m)).Msg("primary backend failed, using fallback")
+	} else {
+		f.logger.Warn().Err(err).Int("entries", len(m)).Msg("primary backend failed, using fallback")
+	}
+
+	for key, entry := range m {
+		entry.Fields = fields[key]
+	}
+
+	s := span.Child("fallback", trace.KindInternal)
+	s.SetAttribute("entries", len(m))
+	ferr := f.fallback.Fetch(m, s)
+	s.SetError(ferr)
+	s.End()
+
+	if ferr != nil {
+		metricFallbacks.With("error").Inc()
+		f.logger.Error().Err(ferr).Msg("fallback failed")
+		return err
+	}
+
+	metricFallbacks.With("success").Inc()
+
+	expires := util.Now().Add(f.ttl)
+	for _, entry := range m {
+		if entry.Expires.After(expires) {
+			entry.Expires = expires
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package fetcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ip-api/proxy/internal/metrics"
+)
+
+const (
+	// How many recent upstream latencies are kept.
+	latencySamples = 200
+	// No requests are hedged before this many latencies are known.
+	minLatencySamples = 20
+)
+
+var (
+	metricHedges       = metrics.NewCounter("ipapi_proxy_upstream_hedges_total", "Number of batches which were also sent to a second PoP because the first was slow.")
+	metricHedgeWins    = metrics.NewCounter("ipapi_proxy_upstream_hedge_wins_total", "Number of hedged batches where the response of the second PoP was used.")
+	metricHedgeLookups = metrics.NewCounter("ipapi_proxy_upstream_hedge_lookups_total", "Number of lookups in successful requests to the second PoP of hedged batches.")
+)
+
+// latencies keeps the durations of the most recent successful upstream requests.
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+// sorted returns the latencies from low to high.
+func (l *latencies) sorted() []time.Duration {
+	l.mu.Lock()
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	l.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return sorted
+}
+
+// percentile returns the p-th percentile of the latencies,
+// or false if there aren't enough to tell.
+func (l *latencies) percentile(p int) (time.Duration, bool) {
+	sorted := l.sorted()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+
+	return sorted[len(sorted)*p/100], true
+}
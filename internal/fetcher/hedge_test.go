@@ -0,0 +1,187 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+
+	"github.com/ip-api/proxy/internal/breaker"
+	"github.com/ip-api/proxy/internal/budget"
+	"github.com/ip-api/proxy/internal/config"
+)
+
+// testPop is a PoP served by a local TLS server which answers with its name after delay.
+type testPop struct {
+	delay  time.Duration
+	status int
+	header map[string]string
+
+	requests int64 // Only accessed atomically.
+	arrived  int64 // Nanoseconds after start the last request arrived, only accessed atomically.
+}
+
+// newTestIPApi returns an ipApi which sends requests to pops, ranked in the order they are given.
+// The time the requests arrive at is relative to the returned start.
+func newTestIPApi(t *testing.T, cfg config.Config, pops ...*testPop) (*ipApi, *time.Time) {
+	b, err := budget.New(zerolog.Nop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &ipApi{
+		logger:  zerolog.Nop(),
+		budget:  b,
+		clients: make(map[string]*fasthttp.HostClient),
+	}
+	f.Reload(cfg)
+
+	start := new(time.Time)
+
+	for i, p := range pops {
+		name := fmt.Sprintf("pop%d", i+1)
+		p := p
+
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&p.requests, 1)
+			atomic.StoreInt64(&p.arrived, int64(time.Since(*start)))
+
+			time.Sleep(p.delay)
+			for k, v := range p.header {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(p.status)
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(ts.Close)
+
+		s := &server{
+			IP:      fmt.Sprintf("10.0.0.%d", i+1),
+			Pop:     name,
+			Stats:   newStats(),
+			Breaker: breaker.New(),
+		}
+		s.Stats.observe(time.Duration(i+1)*time.Millisecond, true)
+		f.servers = append(f.servers, s)
+
+		f.clients[s.IP] = &fasthttp.HostClient{
+			Addr:        ts.Listener.Addr().String(),
+			IsTLS:       true,
+			TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+			ReadTimeout: time.Second,
+		}
+	}
+
+	return f, start
+}
+
+// fetch sends a batch with lookups entries through f.do and returns the name of the PoP whose response was used.
+func fetch(f *ipApi, start *time.Time, lookups int) (string, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	if err := req.URI().Parse(nil, []byte("https://pro.ip-api.com/batch")); err != nil {
+		return "", err
+	}
+	req.Header.SetMethod(fasthttp.MethodPost)
+
+	*start = time.Now()
+
+	var pop string
+	err := f.do(req, nil, lookups, true, func(res *fasthttp.Response) (bool, error) {
+		pop = string(res.Body())
+		return false, nil
+	})
+
+	return pop, err
+}
+
+func TestHedge(t *testing.T) {
+	const hedgeAfter = time.Millisecond * 50
+
+	tests := []struct {
+		name      string
+		primary   testPop
+		hedge     testPop
+		hardLimit int
+		expected  string
+		hedged    bool
+	}{
+		{"fast primary isn't hedged", testPop{status: 200}, testPop{status: 200}, 0, "pop1", false},
+		{"first success wins", testPop{delay: time.Millisecond * 300, status: 200}, testPop{status: 200}, 0, "pop2", true},
+		{"failed hedge doesn't hide the primary", testPop{delay: time.Millisecond * 300, status: 200}, testPop{status: 500}, 0, "pop1", true},
+		{"failed primary doesn't hide the hedge", testPop{delay: time.Millisecond * 100, status: 500}, testPop{delay: time.Millisecond * 200, status: 200}, 0, "pop2", true},
+		// 2 lookups fit, but not 2 more for the hedge.
+		{"no hedge past the hard limit", testPop{delay: time.Millisecond * 300, status: 200}, testPop{status: 200}, 3, "pop1", false},
+		{"hedge up to the hard limit", testPop{delay: time.Millisecond * 300, status: 200}, testPop{status: 200}, 4, "pop2", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Retries = 1
+			cfg.HedgePercentile = 95
+			cfg.BudgetDailyHard = test.hardLimit
+
+			primary, hedge := test.primary, test.hedge
+			f, start := newTestIPApi(t, cfg, &primary, &hedge)
+			for i := 0; i < minLatencySamples; i++ {
+				f.latencies.add(hedgeAfter)
+			}
+
+			pop, err := fetch(f, start, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pop != test.expected {
+				t.Errorf("expected the response of %s got %s", test.expected, pop)
+			}
+
+			if n := atomic.LoadInt64(&primary.requests); n != 1 {
+				t.Errorf("expected 1 request to the primary got %d", n)
+			}
+			if n := atomic.LoadInt64(&hedge.requests); (n == 1) != test.hedged {
+				t.Errorf("expected hedged %t got %d requests to the second pop", test.hedged, n)
+			}
+			if arrived := time.Duration(atomic.LoadInt64(&hedge.arrived)); test.hedged && arrived < hedgeAfter {
+				t.Errorf("expected the hedge after %s got %s", hedgeAfter, arrived)
+			}
+		})
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	cfg := config.Default()
+	cfg.Retries = 1
+	cfg.HedgePercentile = 95
+	cfg.BudgetDailyHard = 4
+
+	primary, hedge := testPop{delay: time.Millisecond * 200, status: 200}, testPop{status: 200}
+	f, start := newTestIPApi(t, cfg, &primary, &hedge)
+	for i := 0; i < minLatencySamples; i++ {
+		f.latencies.add(time.Millisecond * 10)
+	}
+
+	hedgeLookups := metricHedgeLookups.Value()
+
+	if _, err := fetch(f, start, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The discarded response of the primary arrives later and is counted as well.
+	deadline := time.Now().Add(time.Second)
+	for f.budget.State() != budget.Hard && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if state := f.budget.State(); state != budget.Hard {
+		t.Errorf("expected both requests to be spent and the budget to be hard got %s", state)
+	}
+	if n := metricHedgeLookups.Value() - hedgeLookups; n != 2 {
+		t.Errorf("expected 2 hedged lookups got %d", n)
+	}
+}
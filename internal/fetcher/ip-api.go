@@ -4,8 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,122 +12,253 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/valyala/fasthttp"
 
+	"github.com/ip-api/proxy/internal/breaker"
+	"github.com/ip-api/proxy/internal/budget"
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/egress"
 	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/retry"
 	"github.com/ip-api/proxy/internal/reverse"
 	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/trace"
 	"github.com/ip-api/proxy/internal/util"
 )
 
 type Client interface {
-	Fetch(map[string]*structs.CacheEntry) error
-	FetchSelf(lang string, fields field.Fields) (structs.Response, error)
+	// Fetch sets the response of all entries, span is the parent of all spans created while fetching.
+	Fetch(m map[string]*structs.CacheEntry, span *trace.Span) error
 	Debug() interface{}
+	// Readiness returns why the client can't fetch entries, or nil if it can.
+	Readiness() []string
+	// Reload applies the settings in cfg which can change without a restart.
+	Reload(cfg config.Config)
+	// PreferStale returns true if expired entries should be served instead of being fetched,
+	// because the upstream budget is running out.
+	PreferStale() bool
 }
 
 type ipApi struct {
 	mu sync.Mutex
 
+	logger   zerolog.Logger
+	dialer   *egress.Dialer
 	reverser reverse.Reverser
+	budget   *budget.Budget
 
 	clients  map[string]*fasthttp.HostClient
 	batchURL string
-	selfURL  string
 	ttl      time.Duration
 
-	servers []*server
-	retries int
+	servers       []*server
+	ranked        time.Time
+	retries       int
+	retryBackoff  time.Duration
+	retryDeadline time.Duration
+	popsRefresh   time.Duration
+	// Signals refreshServers that POPS_REFRESH changed.
+	popsRefreshChanged chan struct{}
+
+	hedgePercentile int
+	latencies       latencies
+
+	balance     string
+	balancePops int
+
+	// If requests can go to pro.ip-api.com from DNS when no PoP can be used.
+	// Not when POPS_STATIC or POPS_EXCLUDE limit where requests may go.
+	dnsFallback bool
 }
 
-var ErrRetryLimitReached = errors.New("reached retry limit")
+var (
+	ErrRetryLimitReached = errors.New("reached retry limit")
+	// ErrNoPop is returned when no PoP can be used and requests can't fall back on DNS.
+	ErrNoPop = errors.New("no pop can be used")
+)
 
-func NewIPApi(logger zerolog.Logger, reverser reverse.Reverser) (*ipApi, error) {
-	ttl := time.Hour * 24
-	if v := os.Getenv("CACHE_TTL"); v != "" {
-		if d, err := time.ParseDuration(v); err != nil {
-			return nil, err
-		} else {
-			ttl = d
-		}
-	}
+var (
+	metricRequests = metrics.NewCounterVec("ipapi_proxy_upstream_requests_total", "Number of requests sent to ip-api per PoP.", "pop")
+	metricErrors   = metrics.NewCounterVec("ipapi_proxy_upstream_errors_total", "Number of failed requests to ip-api per PoP.", "pop")
+	metricRetries  = metrics.NewCounterVec("ipapi_proxy_upstream_retries_total", "Number of retried requests to ip-api per PoP.", "pop")
+	metricLatency  = metrics.NewHistogramVec(
+		"ipapi_proxy_upstream_request_duration_seconds",
+		"Duration of requests to ip-api per PoP.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		"pop",
+	)
+)
 
-	retries := 4
-	if v := os.Getenv("RETRIES"); v != "" {
-		if i, err := strconv.Atoi(v); err != nil {
-			return nil, err
-		} else {
-			retries = i
-		}
+// NewIPApi returns a Client for ip-api.com. Lookups are counted in b, which can be nil.
+func NewIPApi(logger zerolog.Logger, reverser reverse.Reverser, cfg config.Config, b *budget.Budget) (*ipApi, error) {
+	dialer, err := egress.New(cfg.EgressProxy)
+	if err != nil {
+		return nil, fmt.Errorf("EGRESS_PROXY: %w", err)
+	}
+	if dialer != nil {
+		logger.Info().Str("proxy", dialer.String()).Msg("connecting to ip-api.com through a proxy")
 	}
 
 	f := &ipApi{
+		logger:   logger,
+		dialer:   dialer,
 		reverser: reverser,
+		budget:   b,
 		clients:  make(map[string]*fasthttp.HostClient),
-		batchURL: "https://pro.ip-api.com/batch?key=" + os.Getenv("IP_API_KEY"),
-		selfURL:  "https://pro.ip-api.com/json/?key=" + os.Getenv("IP_API_KEY"),
-		ttl:      ttl,
-		retries:  retries,
-	}
 
-	serverRefreshRate := time.Hour
-	if v := os.Getenv("POPS_REFRESH"); v != "" {
-		if d, err := time.ParseDuration(v); err != nil {
-			logger.Error().Err(err).Msg("invalid POPS_REFRESH")
-		} else {
-			serverRefreshRate = d
-		}
+		popsRefreshChanged: make(chan struct{}, 1),
+		dnsFallback:        len(cfg.PopsStatic) == 0 && len(cfg.PopsExclude) == 0,
 	}
+	f.Reload(cfg)
+
+	go f.refreshServers(cfg)
 
 	go func() {
 		for {
-			servers, err := getServers(logger, f.servers)
-			if err != nil {
-				logger.Error().Err(err).Msg("failed to fetch pops")
-
-				// Try again after a minute.
-				time.Sleep(time.Minute)
-				continue
-			}
+			time.Sleep(probeInterval)
 
 			f.mu.Lock()
-			f.servers = servers
+			servers := append([]*server(nil), f.servers...)
 			f.mu.Unlock()
 
-			time.Sleep(serverRefreshRate)
+			for _, s := range servers {
+				probe(logger, dialer, s)
+			}
 		}
 	}()
 
 	return f, nil
 }
 
+// refreshServers loads the PoP list and refreshes it every POPS_REFRESH.
+func (f *ipApi) refreshServers(cfg config.Config) {
+	for {
+		f.mu.Lock()
+		current := append([]*server(nil), f.servers...)
+		f.mu.Unlock()
+
+		servers, fresh, err := getServers(f.logger, cfg, f.dialer, current)
+		if err != nil {
+			f.logger.Error().Err(err).Msg("failed to fetch pops")
+
+			// Try again after a minute.
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		f.mu.Lock()
+		f.servers = servers
+		f.mu.Unlock()
+
+		f.waitRefresh(time.Now(), fresh)
+	}
+}
+
+// waitRefresh waits until the PoP list fetched at fetched has to be refreshed.
+// If it isn't fresh, it was loaded from POPS_FILE or an older list was kept, that is after a minute.
+func (f *ipApi) waitRefresh(fetched time.Time, fresh bool) {
+	for {
+		f.mu.Lock()
+		refresh := f.popsRefresh
+		f.mu.Unlock()
+
+		if !fresh {
+			refresh = time.Minute
+		}
+
+		timer := time.NewTimer(time.Until(fetched.Add(refresh)))
+		select {
+		case <-timer.C:
+			return
+		case <-f.popsRefreshChanged:
+			// Wait again with the new POPS_REFRESH.
+			timer.Stop()
+		}
+	}
+}
+
+// Reload applies CACHE_TTL, RETRIES, RETRY_BACKOFF, RETRY_DEADLINE, HEDGE_PERCENTILE, BALANCE, BALANCE_POPS,
+// POPS_REFRESH and IP_API_KEY from cfg.
+// A new POPS_REFRESH applies right away: the PoP list is refreshed when it is older than the new interval.
+func (f *ipApi) Reload(cfg config.Config) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.batchURL = "https://pro.ip-api.com/batch?key=" + cfg.IPAPIKey
+	f.ttl = cfg.CacheTTL
+	f.retries = cfg.Retries
+	f.retryBackoff = cfg.RetryBackoff
+	f.retryDeadline = cfg.RetryDeadline
+	f.hedgePercentile = cfg.HedgePercentile
+	f.balance = cfg.Balance
+	f.balancePops = cfg.BalancePops
+
+	if f.popsRefresh != cfg.PopsRefresh {
+		f.popsRefresh = cfg.PopsRefresh
+
+		select {
+		case f.popsRefreshChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (f *ipApi) Debug() interface{} {
-	return f.servers
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*server(nil), f.servers...)
+}
+
+func (f *ipApi) PreferStale() bool {
+	return f.budget.State() != budget.OK
 }
 
-func (f *ipApi) getBatchServerAndClient() (*server, *fasthttp.HostClient) {
+func (f *ipApi) Readiness() []string {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Only try servers which haven't return any error in the last minute.
-	noErrorAfter := time.Now().Add(-time.Minute)
-	var s *server
-	for _, ss := range f.servers {
-		if !ss.LastError.After(noErrorAfter) {
-			s = ss
-			break
+	if len(f.servers) == 0 {
+		return []string{"no pop list loaded"}
+	}
+
+	for _, s := range f.servers {
+		if s.Breaker.State() != breaker.Open {
+			return nil
 		}
 	}
 
+	return []string{fmt.Sprintf("the circuit breakers of all %d pops are open", len(f.servers))}
+}
+
+// getBatchServerAndClient returns the server to use other than exclude, see BALANCE, and a client for it.
+// If no server can be used it returns a nil server and a client for pro.ip-api.com from DNS,
+// or ErrNoPop if that isn't allowed.
+func (f *ipApi) getBatchServerAndClient(exclude *server) (*server, *fasthttp.HostClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Rank the servers again with their latest stats.
+	if now := time.Now(); now.Sub(f.ranked) >= rankInterval {
+		rank(f.servers)
+		f.ranked = now
+	}
+
+	s := f.pickLocked(exclude)
+
 	// If no server was found we fall back on normal DNS.
-	host := "pro.ip-api.com"
+	host := upstreamHost
 	if s != nil {
 		host = s.IP
+	} else if !f.dnsFallback {
+		return nil, nil, ErrNoPop
 	}
 
 	client, ok := f.clients[host]
 	if !ok {
 		client = &fasthttp.HostClient{
-			Addr:                          "pro.ip-api.com:443",
+			Addr:                          upstreamHost + ":443",
 			IsTLS:                         true,
+			TLSConfig:                     upstreamTLSConfig,
 			NoDefaultUserAgentHeader:      true, // Don't send: User-Agent: fasthttp
 			MaxConns:                      100,
 			ReadTimeout:                   time.Second,
@@ -137,21 +266,31 @@ func (f *ipApi) getBatchServerAndClient() (*server, *fasthttp.HostClient) {
 			MaxIdleConnDuration:           time.Minute,
 			DisableHeaderNamesNormalizing: true, // We always set the correct case on our header.
 			Dial: func(addr string) (net.Conn, error) {
-				return fasthttp.Dial(host + ":443")
+				return f.dialer.Dial(host + ":443")
 			},
 		}
 		f.clients[host] = client
 	}
 
-	return s, client
+	return s, client, nil
 }
 
-func (f *ipApi) Fetch(m map[string]*structs.CacheEntry) error {
+func (f *ipApi) Fetch(m map[string]*structs.CacheEntry, span *trace.Span) error {
+	// The whole batch has to fit in the budget.
+	if err := f.budget.Allow(len(m)); err != nil {
+		return err
+	}
+
 	entries := make(structs.CacheEntries, 0, len(m))
 	reverses := make([]*string, 0, len(m))
 
 	var wg sync.WaitGroup
-	defer wg.Wait() // Wait for all reverse lookups to be done before we return.
+	defer func() {
+		// Wait for all reverse lookups to be done before we return.
+		s := span.Child("reverse wait", trace.KindInternal)
+		wg.Wait()
+		s.End()
+	}()
 
 	for _, entry := range m {
 		entry.Fields = entry.Fields.Merge(field.FieldStatus)
@@ -161,7 +300,7 @@ func (f *ipApi) Fetch(m map[string]*structs.CacheEntry) error {
 		if entry.Fields.Contains(field.FieldReverse) {
 			s := ""
 			reverses = append(reverses, &s)
-			f.reverser.Lookup(entry.IP, &s, &wg)
+			f.reverser.Lookup(entry.IP, &s, &wg, span)
 			entry.Fields = entry.Fields.Remove(field.FieldReverse) // Don't also let the backend do a reverse lookup.
 		} else {
 			reverses = append(reverses, nil)
@@ -171,7 +310,11 @@ func (f *ipApi) Fetch(m map[string]*structs.CacheEntry) error {
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
-	if err := req.URI().Parse(nil, []byte(f.batchURL)); err != nil {
+	f.mu.Lock()
+	batchURL, ttl := f.batchURL, f.ttl
+	f.mu.Unlock()
+
+	if err := req.URI().Parse(nil, []byte(batchURL)); err != nil {
 		return err
 	}
 	req.Header.SetMethod(fasthttp.MethodPost)
@@ -182,52 +325,95 @@ func (f *ipApi) Fetch(m map[string]*structs.CacheEntry) error {
 		return err
 	}
 
-	res := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(res)
-
 	var responses structs.Responses
-	var err error
 
-	for i := 0; i < f.retries; i++ {
-		server, client := f.getBatchServerAndClient()
+	err := f.do(req, span, len(entries), true, func(res *fasthttp.Response) (bool, error) {
+		if err := responses.UnmarshalJSON(res.Body()); err != nil {
+			return true, err
+		}
 
-		if server != nil {
-			atomic.AddInt64(&server.Requests, 1)
+		if len(responses) != len(entries) {
+			if len(responses) == 1 && responses[0].Message != nil {
+				return false, fmt.Errorf("%s", *responses[0].Message)
+			}
+			return false, fmt.Errorf("backend response count (%d) doesn't match requested count (%d)", len(responses), len(entries))
 		}
 
-		if err = client.Do(req, res); err == nil {
-			if err = responses.UnmarshalJSON(res.Body()); err == nil {
-				if len(responses) != len(entries) {
-					if len(responses) == 1 && responses[0].Message != nil {
-						return fmt.Errorf("%s", *responses[0].Message)
-					}
-					return fmt.Errorf("backend response count (%d) doesn't match requested count (%d)", len(responses), len(entries))
-				}
-
-				for i, entry := range entries {
-					entry.Response = responses[i]
-					entry.Expires = util.Now().Add(f.ttl)
-
-					if r := reverses[i]; r != nil {
-						entry.Fields = entry.Fields.Merge(field.FieldReverse)
-
-						if entry.Response.Status == nil || *entry.Response.Status != "fail" {
-							entry.Response.Reverse = r
-						}
-					}
-				}
-
-				return nil
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		entry.Response = responses[i]
+		entry.Expires = util.Now().Add(ttl)
+
+		if r := reverses[i]; r != nil {
+			entry.Fields = entry.Fields.Merge(field.FieldReverse)
+
+			if entry.Response.Status == nil || *entry.Response.Status != "fail" {
+				entry.Response.Reverse = r
 			}
 		}
+	}
 
-		if server != nil {
-			atomic.AddInt64(&server.Errors, 1)
+	return nil
+}
 
-			f.mu.Lock()
-			server.LastError = time.Now()
-			f.mu.Unlock()
+// do sends req until handle accepts the response. handle returns if the request should be
+// retried when it returns an error. Failed requests are retried depending on the class of
+// the failure, with a backoff, at most RETRIES times and not after RETRY_DEADLINE.
+// If hedge is true, requests can be hedged, see try.
+// lookups is the number of lookups in req, they are counted in the budget for every successful response.
+func (f *ipApi) do(req *fasthttp.Request, span *trace.Span, lookups int, hedge bool, handle func(*fasthttp.Response) (bool, error)) error {
+	f.mu.Lock()
+	retries, backoff, deadline := f.retries, f.retryBackoff, time.Now().Add(f.retryDeadline)
+	percentile := f.hedgePercentile
+	f.mu.Unlock()
+
+	var hedgeAfter time.Duration
+	if hedge = hedge && percentile > 0; hedge {
+		hedgeAfter, hedge = f.latencies.percentile(percentile)
+	}
+
+	var err error
+
+	for i := 0; i < retries; i++ {
+		r := f.try(req, span, i, lookups, deadline, hedgeAfter, hedge, handle)
+		err = r.err
+
+		if r.class == retry.OK {
+			// The error, if any, is in the response itself and would be the same on a retry.
+			fasthttp.ReleaseResponse(r.res)
+			return err
+		}
+
+		event := f.logger.Warn().Err(err).Int("attempt", i+1).Str("class", string(r.class))
+		if err != ErrNoPop {
+			event = event.Str("pop", r.server.name())
+		}
+
+		if !r.class.Retryable() {
+			fasthttp.ReleaseResponse(r.res)
+			event.Msg("upstream request failed, not retrying")
+			return err
+		}
+		if i+1 == retries {
+			fasthttp.ReleaseResponse(r.res)
+			event.Msg("upstream request failed, retry limit reached")
+			break
+		}
+
+		wait := retry.Wait(r.class, r.res, i, backoff)
+		fasthttp.ReleaseResponse(r.res)
+		if time.Now().Add(wait).After(deadline) {
+			event.Dur("wait", wait).Msg("upstream request failed, retry deadline reached")
+			return err
 		}
+
+		event.Dur("wait", wait).Msg("upstream request failed, retrying")
+		time.Sleep(wait)
 	}
 
 	if err == nil {
@@ -237,47 +423,197 @@ func (f *ipApi) Fetch(m map[string]*structs.CacheEntry) error {
 	return err
 }
 
-func (f *ipApi) FetchSelf(lang string, fields field.Fields) (structs.Response, error) {
-	req := fasthttp.AcquireRequest()
-	defer fasthttp.ReleaseRequest(req)
+// result of one request to a PoP.
+type result struct {
+	server *server
+	res    *fasthttp.Response
+	class  retry.Class
+	err    error
+	hedged bool
+}
 
-	if err := req.URI().Parse(nil, []byte(f.selfURL+"&lang="+lang+"&fields="+fields.Num())); err != nil {
-		return structs.Response{}, err
+// try sends req to the best PoP. If hedge is true and there is no response after hedgeAfter
+// req is also sent to the next best PoP. The first successful response which handle accepts
+// wins. fasthttp can't cancel a request, so the response of the other one is discarded when
+// it arrives, which is at most the ReadTimeout later. Both responses count towards the budget,
+// so req isn't hedged if that would go past a hard limit.
+// The returned response has to be released.
+func (f *ipApi) try(req *fasthttp.Request, span *trace.Span, i, lookups int, deadline time.Time, hedgeAfter time.Duration, hedge bool, handle func(*fasthttp.Response) (bool, error)) result {
+	results := make(chan result, 2)
+
+	server, client, err := f.getBatchServerAndClient(nil)
+	if err != nil {
+		// A breaker can close or the PoP list can load before the next attempt.
+		return result{res: fasthttp.AcquireResponse(), class: retry.Unavailable, err: err}
+	}
+	go f.send(server, client, copyRequest(req), span, i, lookups, deadline, false, results)
+	pending := 1
+
+	var hedgeTimer <-chan time.Time
+	if hedge {
+		t := time.NewTimer(hedgeAfter)
+		defer t.Stop()
+		hedgeTimer = t.C
 	}
-	req.Header.SetMethod(fasthttp.MethodGet)
-	req.Header.SetContentType("application/json")
 
-	res := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(res)
+	var r result
+	for {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
 
-	var err error
+			// Both requests count towards the budget if they succeed, the first one didn't yet.
+			if err := f.budget.Allow(2 * lookups); err != nil {
+				f.logger.Debug().Err(err).Str("pop", server.name()).Msg("not hedging upstream request")
+				continue
+			}
 
-	for i := 0; i < f.retries; i++ {
-		server, client := f.getBatchServerAndClient()
+			// Only hedge to another PoP, sending it to the same one again won't be faster.
+			if other, otherClient, err := f.getBatchServerAndClient(server); err == nil && other != nil {
+				f.logger.Debug().Str("pop", server.name()).Str("hedge", other.name()).Dur("after", hedgeAfter).Msg("hedging upstream request")
+				metricHedges.Inc()
 
-		if server != nil {
-			atomic.AddInt64(&server.Requests, 1)
+				go f.send(other, otherClient, copyRequest(req), span, i, lookups, deadline, true, results)
+				pending++
+			}
+			continue
+		case r = <-results:
+			pending--
 		}
 
-		if err = client.Do(req, res); err == nil {
-			var response structs.Response
-			if err := response.UnmarshalJSON(res.Body()); err == nil {
-				return response, nil
+		if r.class == retry.OK {
+			var again bool
+			if again, r.err = handle(r.res); r.err != nil && again {
+				r.class = retry.Invalid
 			}
 		}
+		f.record(r.server, r.class)
 
-		if server != nil {
-			atomic.AddInt64(&server.Errors, 1)
-
-			f.mu.Lock()
-			server.LastError = time.Now()
-			f.mu.Unlock()
+		if r.class == retry.OK || pending == 0 {
+			break
 		}
+
+		// Wait for the other request.
+		fasthttp.ReleaseResponse(r.res)
+	}
+
+	if r.hedged && r.class == retry.OK {
+		metricHedgeWins.Inc()
 	}
 
+	if pending > 0 {
+		go func() {
+			lost := <-results
+			f.record(lost.server, lost.class)
+			fasthttp.ReleaseResponse(lost.res)
+		}()
+	}
+
+	return r
+}
+
+// copyRequest returns a copy of req for send. The request that lost against a hedge is still
+// sent after try returned, when req can already be released or reused for the next attempt.
+func copyRequest(req *fasthttp.Request) *fasthttp.Request {
+	r := fasthttp.AcquireRequest()
+	req.CopyTo(r)
+	return r
+}
+
+// send sends req to server using client and sends the result to results. req is released.
+func (f *ipApi) send(server *server, client *fasthttp.HostClient, req *fasthttp.Request, span *trace.Span, i, lookups int, deadline time.Time, hedged bool, results chan<- result) {
+	if server != nil {
+		atomic.AddInt64(&server.Requests, 1)
+	}
+	pop := server.name()
+	metricRequests.With(pop).Inc()
+	if i > 0 && !hedged {
+		metricRetries.With(pop).Inc()
+	}
+
+	attempt := span.Child("upstream request", trace.KindClient)
+	attempt.SetAttribute("pop", pop)
+	attempt.SetAttribute("retry", i)
+	attempt.SetAttribute("hedge", hedged)
+	attempt.SetAttribute("entries", lookups)
+
+	res := fasthttp.AcquireResponse()
+
+	if server != nil {
+		server.Stats.start()
+	}
+	start := time.Now()
+	err := client.DoDeadline(req, res, deadline)
+	took := time.Since(start)
+	if server != nil {
+		server.Stats.done()
+	}
+	metricLatency.With(pop).Observe(took.Seconds())
+	fasthttp.ReleaseRequest(req)
+
+	class := retry.Network
 	if err == nil {
-		err = ErrRetryLimitReached
+		attempt.SetAttribute("http.status_code", res.StatusCode())
+
+		// Other requests to the PoP would be rate limited until the window resets.
+		if wait, ok := retry.Exhausted(res); ok && server != nil {
+			f.logger.Debug().Str("pop", pop).Dur("wait", wait).Msg("upstream rate limit exhausted, holding back requests")
+			server.hold(time.Now().Add(wait))
+		}
+
+		if class = retry.Classify(res.StatusCode()); class == retry.OK {
+			f.budget.Spend(lookups)
+			f.latencies.add(took)
+			if hedged {
+				metricHedgeLookups.Add(int64(lookups))
+			}
+		} else {
+			err = fmt.Errorf("upstream returned status %d", res.StatusCode())
+		}
+	}
+
+	if server != nil {
+		server.Stats.observe(took, !failed(class))
+	}
+
+	if class != retry.OK {
+		attempt.SetAttribute("retry.class", string(class))
+		attempt.SetError(err)
+		metricErrors.With(pop).Inc()
+	}
+	attempt.End()
+
+	results <- result{
+		server: server,
+		res:    res,
+		class:  class,
+		err:    err,
+		hedged: hedged,
+	}
+}
+
+// failed returns true if a request of class failed because of the PoP.
+// Wrong requests and our key being rate limited aren't the fault of the PoP,
+// other PoPs won't accept them either.
+func failed(class retry.Class) bool {
+	return class != retry.OK && class != retry.Client && class != retry.RateLimited
+}
+
+// record records the outcome of a request in the circuit breaker of s.
+func (f *ipApi) record(s *server, class retry.Class) {
+	if s == nil {
+		return
 	}
 
-	return structs.Response{}, err
+	if failed(class) {
+		atomic.AddInt64(&s.Errors, 1)
+	}
+
+	if state, changed := s.Breaker.Record(!failed(class)); changed {
+		event := f.logger.Info()
+		if state == breaker.Open {
+			event = f.logger.Warn()
+		}
+		event.Str("pop", s.name()).Str("state", state.String()).Msg("circuit breaker state changed")
+	}
 }
@@ -0,0 +1,240 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/mmdb"
+	"github.com/ip-api/proxy/internal/reverse"
+	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/trace"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+type mmdbClient struct {
+	logger zerolog.Logger
+
+	reverser reverse.Reverser
+
+	paths   []string
+	readers []*mmdb.Reader
+	ttl     int64 // time.Duration, accessed atomically.
+}
+
+// NewMMDB returns a Client which answers from the local MaxMind format databases in MMDB_FILE.
+// With multiple databases, for example a City and an ASN database,
+// the first database that contains a value for a field is used.
+func NewMMDB(logger zerolog.Logger, reverser reverse.Reverser, cfg config.Config) (*mmdbClient, error) {
+	if len(cfg.MMDBFile) == 0 {
+		return nil, errors.New("MMDB_FILE is required")
+	}
+
+	f := &mmdbClient{
+		logger:   logger,
+		reverser: reverser,
+		ttl:      int64(cfg.CacheTTL),
+	}
+
+	for _, path := range cfg.MMDBFile {
+		r, err := mmdb.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+
+		logger.Info().Str("file", path).Str("type", r.Metadata.DatabaseType).Msg("opened mmdb database")
+
+		f.paths = append(f.paths, path)
+		f.readers = append(f.readers, r)
+	}
+
+	return f, nil
+}
+
+func (f *mmdbClient) Debug() interface{} {
+	databases := make(map[string]mmdb.Metadata, len(f.readers))
+	for i, r := range f.readers {
+		databases[f.paths[i]] = r.Metadata
+	}
+	return databases
+}
+
+// Reload applies CACHE_TTL from cfg.
+func (f *mmdbClient) Reload(cfg config.Config) {
+	atomic.StoreInt64(&f.ttl, int64(cfg.CacheTTL))
+}
+
+func (f *mmdbClient) PreferStale() bool {
+	return false
+}
+
+func (f *mmdbClient) Readiness() []string {
+	// The databases are loaded when the client is created.
+	return nil
+}
+
+func (f *mmdbClient) Fetch(m map[string]*structs.CacheEntry, span *trace.Span) error {
+	var wg sync.WaitGroup
+
+	reverses := make(map[*structs.CacheEntry]*string)
+	ttl := time.Duration(atomic.LoadInt64(&f.ttl))
+
+	for _, entry := range m {
+		entry.Fields = entry.Fields.Merge(field.FieldStatus)
+
+		response := f.lookup(entry.IP, entry.Lang)
+		if !response.Failed() && entry.Fields.Contains(field.FieldReverse) {
+			s := ""
+			reverses[entry] = &s
+			f.reverser.Lookup(entry.IP, &s, &wg, span)
+		}
+
+		entry.Response = response.Trim(entry.Fields)
+		entry.Expires = util.Now().Add(ttl)
+		entry.Source = structs.SourceMMDB
+	}
+
+	wg.Wait()
+
+	for entry, r := range reverses {
+		entry.Response.Reverse = r
+	}
+
+	return nil
+}
+
+// lookup returns the response for ip with all fields the databases contain.
+func (f *mmdbClient) lookup(ip string, lang string) structs.Response {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return structs.ErrorResponse("fail", "invalid query")
+	}
+
+	var r structs.Response
+	found := false
+
+	for i, reader := range f.readers {
+		record, ok, err := reader.Lookup(parsed)
+		if err != nil {
+			f.logger.Error().Err(err).Str("file", f.paths[i]).Str("ip", ip).Msg("failed to look up ip")
+			continue
+		} else if !ok {
+			continue
+		}
+
+		if m, ok := record.(map[string]interface{}); ok {
+			found = true
+			fillResponse(&r, m, lang)
+		}
+	}
+
+	if !found {
+		r = structs.ErrorResponse("fail", "not found")
+	} else {
+		r.Status = str("success")
+	}
+	r.Query = &ip
+
+	return r
+}
+
+// fillResponse sets the fields of r which aren't set yet from a GeoIP2 or GeoLite2 record.
+// See: https://dev.maxmind.com/geoip/docs/databases
+func fillResponse(r *structs.Response, m map[string]interface{}, lang string) {
+	setStr := func(p **string, v string) {
+		if *p == nil && v != "" {
+			*p = &v
+		}
+	}
+	setBool := func(p **bool, v interface{}) {
+		if b, ok := v.(bool); ok && *p == nil {
+			*p = &b
+		}
+	}
+
+	continent := mmdbMap(m["continent"])
+	setStr(&r.Continent, mmdbName(continent, lang))
+	setStr(&r.ContinentCode, mmdbString(continent["code"]))
+
+	country := mmdbMap(m["country"])
+	setStr(&r.Country, mmdbName(country, lang))
+	setStr(&r.CountryCode, mmdbString(country["iso_code"]))
+
+	if subdivisions, ok := m["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		subdivision := mmdbMap(subdivisions[0])
+		setStr(&r.Region, mmdbString(subdivision["iso_code"]))
+		setStr(&r.RegionName, mmdbName(subdivision, lang))
+	}
+
+	setStr(&r.City, mmdbName(mmdbMap(m["city"]), lang))
+	setStr(&r.Zip, mmdbString(mmdbMap(m["postal"])["code"]))
+
+	location := mmdbMap(m["location"])
+	if lat, ok := location["latitude"].(float64); ok && r.Lat == nil {
+		r.Lat = &lat
+	}
+	if lon, ok := location["longitude"].(float64); ok && r.Lon == nil {
+		r.Lon = &lon
+	}
+	if tz := mmdbString(location["time_zone"]); tz != "" && r.Timezone == nil {
+		r.Timezone = &tz
+		if loc, err := time.LoadLocation(tz); err == nil {
+			_, offset := util.Now().In(loc).Zone()
+			r.Offset = &offset
+		}
+	}
+
+	// ASN and ISP databases have these at the top level, Enterprise databases in traits.
+	for _, t := range []map[string]interface{}{m, mmdbMap(m["traits"])} {
+		org := mmdbString(t["autonomous_system_organization"])
+		if isp := mmdbString(t["isp"]); isp != "" {
+			setStr(&r.ISP, isp)
+		} else {
+			setStr(&r.ISP, org)
+		}
+		if o := mmdbString(t["organization"]); o != "" {
+			setStr(&r.Org, o)
+		} else {
+			setStr(&r.Org, org)
+		}
+		if asn, ok := t["autonomous_system_number"].(uint64); ok {
+			setStr(&r.AS, strings.TrimSpace(fmt.Sprintf("AS%d %s", asn, org)))
+		}
+
+		if ct, ok := t["connection_type"].(string); ok && r.Mobile == nil {
+			mobile := ct == "Cellular"
+			r.Mobile = &mobile
+		}
+		setBool(&r.Proxy, t["is_anonymous_proxy"])
+		setBool(&r.Proxy, t["is_anonymous"])
+		setBool(&r.Hosting, t["is_hosting_provider"])
+	}
+}
+
+func mmdbMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func mmdbString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// mmdbName returns the name in lang, or the English name if there is none.
+// The databases use the same language codes as ip-api.com.
+func mmdbName(m map[string]interface{}, lang string) string {
+	names := mmdbMap(m["names"])
+	if name := mmdbString(names[lang]); name != "" {
+		return name
+	}
+	return mmdbString(names["en"])
+}
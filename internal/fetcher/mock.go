@@ -5,44 +5,54 @@ import (
 	"sync"
 	"time"
 
-	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/config"
 	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/trace"
 	"github.com/ip-api/proxy/internal/util"
 )
 
 type Mock struct {
 	sync.Mutex
-	Requests []int // batch size of each batch request.
+	Requests  []int // batch size of each batch request.
+	SoftLimit bool  // PreferStale returns this.
 }
 
-func (mo *Mock) Fetch(m map[string]*structs.CacheEntry) error {
+func (mo *Mock) Fetch(m map[string]*structs.CacheEntry, span *trace.Span) error {
 	mo.Lock()
 	defer mo.Unlock()
 
 	mo.Requests = append(mo.Requests, len(m))
 
-	if _, ok := m["0.0.0.0en"]; ok {
+	if _, ok := m["1.2.3.4en"]; ok {
 		return errors.New("test error")
 	}
 
 	for key, entry := range m {
-		entry.Response = MockResponseFor(key)
+		// Like ip-api.com only return the requested fields.
+		entry.Response = MockResponseFor(key).Trim(entry.Fields)
 		entry.Expires = util.Now().Add(time.Minute)
 	}
 	return nil
 }
 
-func (mo *Mock) FetchSelf(lang string, fields field.Fields) (structs.Response, error) {
-	mo.Lock()
-	defer mo.Unlock()
-
-	return structs.Response{}, nil
+func (mo *Mock) Debug() interface{} {
+	return nil
 }
 
-func (mo *Mock) Debug() interface{} {
+func (mo *Mock) Readiness() []string {
 	return nil
 }
 
+func (mo *Mock) Reload(cfg config.Config) {
+}
+
+func (mo *Mock) PreferStale() bool {
+	mo.Lock()
+	defer mo.Unlock()
+
+	return mo.SoftLimit
+}
+
 func intp(i int) *int {
 	return &i
 }
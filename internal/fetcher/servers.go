@@ -1,80 +1,221 @@
 package fetcher
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/breaker"
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/egress"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/util"
 )
 
 type server struct {
-	IP        string        `json:"ip"`
-	Pop       string        `json:"pop"`
-	Latency   time.Duration `json:"latency"`
-	LastError time.Time     `json:"last_error"`
-	Requests  int64         `json:"requests"`
-	Errors    int64         `json:"errors"`
+	IP       string           `json:"ip"`
+	Pop      string           `json:"pop"`
+	Stats    *stats           `json:"stats"`
+	Requests int64            `json:"requests"`
+	Errors   int64            `json:"errors"`
+	Breaker  *breaker.Breaker `json:"breaker"`
+	Pin      int              `json:"pin,omitempty"` // Position in POPS_PIN starting at 1, 0 if not pinned.
+
+	weight float64 // Current weight for balanceWeighted, guarded by ipApi.mu.
+	score  float64 // Set by rank, guarded by ipApi.mu.
+
+	// Unix nanoseconds until which no requests are sent because the rate limit is exhausted,
+	// only accessed atomically.
+	heldUntil int64
 }
 
-const latencyPings = 4
+// hold keeps requests from being sent to s until t.
+func (s *server) hold(t time.Time) {
+	atomic.StoreInt64(&s.heldUntil, t.UnixNano())
+}
 
-// latency returns the latency to 'ip' by performing
-// latencyPings requests and returning the average latency.
-func latency(client *http.Client, ip string) time.Duration {
-	u := "http://" + ip + "/ping"
+// held returns true if no requests should be sent to s at now.
+func (s *server) held(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&s.heldUntil)
+}
 
-	var measures []time.Duration
+// matches returns true if s is in list, by PoP name, IP or both as pop/ip.
+func (s *server) matches(list []string) bool {
+	return s.index(list) >= 0
+}
 
-	for i := 0; i < latencyPings; i++ {
-		start := time.Now()
-		if res, err := client.Get(u); err != nil {
-			continue
-		} else if res.StatusCode != http.StatusOK {
-			continue
+func (s *server) index(list []string) int {
+	for i, e := range list {
+		if e == s.Pop || e == s.IP || e == s.name() {
+			return i
 		}
-		measures = append(measures, time.Since(start))
 	}
+	return -1
+}
+
+// name returns the name of the PoP used in metrics.
+// A nil server means we fell back on normal DNS.
+func (s *server) name() string {
+	if s == nil {
+		return "dns"
+	}
+	return s.Pop + "/" + s.IP
+}
+
+var metricProbe = metrics.NewHistogramVec(
+	"ipapi_proxy_upstream_probe_duration_seconds",
+	"Duration of connecting to and the TLS handshake with idle PoPs, per PoP and phase.",
+	[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	"pop", "phase",
+)
+
+const (
+	probeHandshakes = 2
+	probeTimeout    = time.Second * 5
+
+	// How often idle PoPs are probed.
+	probeInterval = time.Second * 30
+	// How often the servers are ranked by their stats.
+	rankInterval = time.Second
+)
+
+// handshake connects to the PoP at ip and does a TLS handshake, like requests to ip-api.com do.
+// It returns how long connecting and the handshake took.
+func handshake(d *egress.Dialer, ip string) (connect time.Duration, tlsHandshake time.Duration, err error) {
+	start := time.Now()
+	conn, err := d.Dial(ip + ":443")
+	if err != nil {
+		return 0, 0, err
+	}
+	connect = time.Since(start)
+
+	c := tls.Client(conn, upstreamTLSConfig)
+	defer c.Close()
 
-	if len(measures) == 0 {
-		return time.Hour
+	if err := c.SetDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return 0, 0, err
 	}
 
-	var measure time.Duration
-	for _, m := range measures {
-		measure += m
+	start = time.Now()
+	if err := c.Handshake(); err != nil {
+		return 0, 0, err
 	}
 
-	return measure / time.Duration(len(measures))
+	return connect, time.Since(start), nil
 }
 
-func getServers(logger zerolog.Logger, current []*server) ([]*server, error) {
-	client := &http.Client{}
+// measure does probeHandshakes handshakes with the PoP at ip and returns the average times.
+// It returns an error if all of them failed.
+func measure(d *egress.Dialer, ip string) (connect time.Duration, tlsHandshake time.Duration, err error) {
+	n := 0
+	for i := 0; i < probeHandshakes; i++ {
+		c, h, e := handshake(d, ip)
+		if e != nil {
+			err = e
+			continue
+		}
+
+		connect += c
+		tlsHandshake += h
+		n++
+	}
 
-	popsUrl := os.Getenv("POPS_URL")
-	if popsUrl == "" {
-		popsUrl = "https://d2e7s0viy93a0y.cloudfront.net/pops.json"
+	if n == 0 {
+		return 0, 0, err
 	}
 
-	res, err := client.Get(popsUrl)
+	return connect / time.Duration(n), tlsHandshake / time.Duration(n), nil
+}
+
+// probe measures the connect and handshake time of s if it didn't get any requests recently.
+func probe(logger zerolog.Logger, d *egress.Dialer, s *server) {
+	if !s.Stats.idle() {
+		return
+	}
+
+	connect, tlsHandshake, err := measure(d, s.IP)
+	s.Stats.observeProbe(connect, tlsHandshake, err == nil)
+
 	if err != nil {
-		return nil, err
+		logger.Debug().Err(err).Str("ip", s.IP).Str("pop", s.Pop).Msg("probe failed")
+		return
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("pops endpoint returned: %s", res.Status)
+	metricProbe.With(s.name(), "connect").Observe(connect.Seconds())
+	metricProbe.With(s.name(), "handshake").Observe(tlsHandshake.Seconds())
+
+	logger.Debug().Dur("connect", connect).Dur("handshake", tlsHandshake).Str("ip", s.IP).Str("pop", s.Pop).Msg("probed idle pop")
+}
+
+// rank sorts servers from best to worst by their score, pinned servers first.
+func rank(servers []*server) {
+	scale := probeScale(servers)
+	for _, s := range servers {
+		s.score = s.Stats.score(scale)
 	}
 
-	var servers []*server
-	if err := json.NewDecoder(res.Body).Decode(&servers); err != nil {
-		return nil, err
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if a.Pin != b.Pin {
+			return b.Pin == 0 || (a.Pin != 0 && a.Pin < b.Pin)
+		}
+		return a.score < b.score
+	})
+}
+
+// probeScale returns how many times longer requests take than connecting, the median of the servers
+// where both are known, or 1 if there are none. Probes only measure the connect time, a single round trip,
+// so it's scaled by this to compare idle servers with the latency of requests to the others.
+func probeScale(servers []*server) float64 {
+	var scales []float64
+	for _, s := range servers {
+		if r := s.Stats.requestsPerConnect(); r > 0 {
+			scales = append(scales, r)
+		}
 	}
 
+	if len(scales) == 0 {
+		return 1
+	}
+
+	sort.Float64s(scales)
+	return scales[len(scales)/2]
+}
+
+// getServers returns the servers from loadServers without the ones in POPS_EXCLUDE, ranked.
+// The current servers keep their stats, new ones are probed. fresh is false if the servers
+// are the last known list from POPS_FILE.
+func getServers(logger zerolog.Logger, cfg config.Config, d *egress.Dialer, current []*server) (servers []*server, fresh bool, err error) {
+	client := d.HTTPClient(probeTimeout)
+
+	servers, fresh, err = loadServers(logger, client, cfg, len(current) == 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	kept := servers[:0]
+	for _, s := range servers {
+		if s.matches(cfg.PopsExclude) {
+			continue
+		}
+		s.Pin = s.index(cfg.PopsPin) + 1
+		kept = append(kept, s)
+	}
+	if len(kept) == 0 {
+		return nil, false, fmt.Errorf("all %d pops are excluded", len(servers))
+	}
+	servers = kept
+
 	// Build a lookup table so we can easily merge the old and new data together.
 	currentMap := make(map[string]*server, len(current))
 	for _, s := range current {
@@ -86,14 +227,19 @@ func getServers(logger zerolog.Logger, current []*server) ([]*server, error) {
 	for i := range servers {
 		go func(s *server) {
 			defer wg.Done()
-			s.Latency = latency(client, s.IP)
 
+			// Known servers keep their stats, new ones are probed.
 			if c, ok := currentMap[s.IP]; ok {
 				s.Requests = atomic.LoadInt64(&c.Requests)
 				s.Errors = atomic.LoadInt64(&c.Errors)
+				s.Stats = c.Stats
+				s.Breaker = c.Breaker
+			} else {
+				s.Stats = newStats()
+				s.Breaker = breaker.New()
 			}
 
-			logger.Debug().Dur("latency", s.Latency).Str("ip", s.IP).Str("pop", s.Pop).Msg("latency")
+			probe(logger, d, s)
 		}(servers[i])
 	}
 	wg.Wait()
@@ -101,10 +247,68 @@ func getServers(logger zerolog.Logger, current []*server) ([]*server, error) {
 	// We don't need this clients or its connections anymore, so close them.
 	client.CloseIdleConnections()
 
-	// Sort the servers by latency ascending.
-	sort.Slice(servers, func(i, j int) bool {
-		return servers[i].Latency < servers[j].Latency
-	})
+	rank(servers)
+
+	return servers, fresh, nil
+}
+
+// loadServers returns the servers in POPS_STATIC if it's set. Otherwise it fetches them from
+// POPS_URL and saves the list to POPS_FILE. If that fails and useFile is true the last known
+// list in POPS_FILE is used, with fresh set to false.
+func loadServers(logger zerolog.Logger, client *http.Client, cfg config.Config, useFile bool) (servers []*server, fresh bool, err error) {
+	if len(cfg.PopsStatic) > 0 {
+		for _, p := range cfg.PopsStatic {
+			s := &server{IP: p}
+			if i := strings.LastIndexByte(p, '/'); i >= 0 {
+				s.Pop, s.IP = p[:i], p[i+1:]
+			}
+			servers = append(servers, s)
+		}
+		return servers, true, nil
+	}
+
+	buf, err := fetchServers(client, cfg.PopsURL)
+	if err == nil {
+		if err = json.Unmarshal(buf, &servers); err == nil {
+			if cfg.PopsFile != "" {
+				if err := util.WriteFile(cfg.PopsFile, buf); err != nil {
+					logger.Error().Err(err).Str("file", cfg.PopsFile).Msg("failed to save pops")
+				}
+			}
+			return servers, true, nil
+		}
+	}
+
+	if !useFile || cfg.PopsFile == "" {
+		return nil, false, err
+	}
+
+	saved, fileErr := ioutil.ReadFile(cfg.PopsFile)
+	if fileErr == nil {
+		fileErr = json.Unmarshal(saved, &servers)
+	}
+	if fileErr != nil {
+		if !os.IsNotExist(fileErr) {
+			logger.Error().Err(fileErr).Str("file", cfg.PopsFile).Msg("failed to load saved pops")
+		}
+		return nil, false, err
+	}
+
+	logger.Warn().Err(err).Str("file", cfg.PopsFile).Msg("failed to fetch pops, using the last known list")
+
+	return servers, false, nil
+}
+
+func fetchServers(client *http.Client, popsURL string) ([]byte, error) {
+	res, err := client.Get(popsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pops endpoint returned: %s", res.Status)
+	}
 
-	return servers, nil
+	return ioutil.ReadAll(res.Body)
 }
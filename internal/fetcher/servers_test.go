@@ -0,0 +1,385 @@
+package fetcher
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+
+	"github.com/ip-api/proxy/internal/breaker"
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/egress"
+)
+
+// Nothing listens on port 443 of these IPs, so probing them fails right away.
+const testPops = `[
+	{"ip": "127.0.0.1", "pop": "ams"},
+	{"ip": "127.0.0.2", "pop": "fra"},
+	{"ip": "127.0.0.3", "pop": "lon"},
+	{"ip": "127.0.0.4", "pop": "nyc"}
+]`
+
+// popsServer serves the PoP list until failing is set to 1 and counts the requests to it.
+type popsServer struct {
+	*httptest.Server
+	requests int64
+	failing  int64
+}
+
+func newPopsServer(t *testing.T) *popsServer {
+	s := &popsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+		if atomic.LoadInt64(&s.failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(testPops))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func names(servers []*server) string {
+	n := make([]string, 0, len(servers))
+	for _, s := range servers {
+		n = append(n, s.name())
+	}
+	return strings.Join(n, ",")
+}
+
+func TestGetServersPinExclude(t *testing.T) {
+	ps := newPopsServer(t)
+
+	tests := []struct {
+		pin      []string
+		exclude  []string
+		expected string
+	}{
+		{nil, nil, "ams/127.0.0.1,fra/127.0.0.2,lon/127.0.0.3,nyc/127.0.0.4"},
+		// Pinned PoPs come first in the order of POPS_PIN, matched by name, IP or both.
+		{[]string{"lon", "127.0.0.2"}, nil, "lon/127.0.0.3,fra/127.0.0.2,ams/127.0.0.1,nyc/127.0.0.4"},
+		{[]string{"nyc/127.0.0.4", "ams"}, nil, "nyc/127.0.0.4,ams/127.0.0.1,fra/127.0.0.2,lon/127.0.0.3"},
+		{nil, []string{"fra", "127.0.0.4"}, "ams/127.0.0.1,lon/127.0.0.3"},
+		// Excluding wins over pinning.
+		{[]string{"lon", "fra"}, []string{"lon"}, "fra/127.0.0.2,ams/127.0.0.1,nyc/127.0.0.4"},
+		// An entry only matches when both the name and IP match.
+		{nil, []string{"ams/127.0.0.2"}, "ams/127.0.0.1,fra/127.0.0.2,lon/127.0.0.3,nyc/127.0.0.4"},
+	}
+
+	for _, test := range tests {
+		cfg := config.Default()
+		cfg.PopsURL = ps.URL
+		cfg.PopsPin = test.pin
+		cfg.PopsExclude = test.exclude
+
+		servers, fresh, err := getServers(zerolog.Nop(), cfg, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fresh {
+			t.Errorf("%v %v: expected a fresh list", test.pin, test.exclude)
+		}
+		if n := names(servers); n != test.expected {
+			t.Errorf("%v %v: expected %s got %s", test.pin, test.exclude, test.expected, n)
+		}
+	}
+
+	cfg := config.Default()
+	cfg.PopsURL = ps.URL
+	cfg.PopsExclude = []string{"ams", "fra", "lon", "nyc"}
+	if _, _, err := getServers(zerolog.Nop(), cfg, nil, nil); err == nil || err.Error() != "all 4 pops are excluded" {
+		t.Errorf("expected all pops to be excluded got %v", err)
+	}
+}
+
+func TestGetServersKeepsStats(t *testing.T) {
+	ps := newPopsServer(t)
+
+	cfg := config.Default()
+	cfg.PopsURL = ps.URL
+
+	current, _, err := getServers(zerolog.Nop(), cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddInt64(&current[1].Requests, 3)
+
+	servers, _, err := getServers(zerolog.Nop(), cfg, nil, current[1:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range servers {
+		if kept := s.IP == current[1].IP; (s.Stats == current[1].Stats) != kept || (s.Requests == 3) != kept {
+			t.Errorf("%s: expected stats to be kept %t", s.name(), kept)
+		}
+	}
+}
+
+func TestLoadServersStatic(t *testing.T) {
+	ps := newPopsServer(t)
+
+	cfg := config.Default()
+	cfg.PopsURL = ps.URL
+	cfg.PopsStatic = []string{"fra/127.0.0.2", "127.0.0.5"}
+
+	servers, fresh, err := loadServers(zerolog.Nop(), http.DefaultClient, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*server{{IP: "127.0.0.2", Pop: "fra"}, {IP: "127.0.0.5"}}
+	if !reflect.DeepEqual(servers, expected) || !fresh {
+		t.Errorf("expected %s got %s", names(expected), names(servers))
+	}
+	if n := atomic.LoadInt64(&ps.requests); n != 0 {
+		t.Errorf("expected POPS_URL not to be fetched got %d requests", n)
+	}
+}
+
+func TestPopsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ps := newPopsServer(t)
+
+	cfg := config.Default()
+	cfg.PopsURL = ps.URL
+	cfg.PopsFile = filepath.Join(dir, "pops.json")
+
+	// Nothing was saved yet.
+	atomic.StoreInt64(&ps.failing, 1)
+	if _, _, err := getServers(zerolog.Nop(), cfg, nil, nil); err == nil {
+		t.Fatal("expected an error without a saved list")
+	}
+
+	atomic.StoreInt64(&ps.failing, 0)
+	fetched, fresh, err := getServers(zerolog.Nop(), cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh {
+		t.Error("expected a fresh list")
+	}
+	if saved, err := ioutil.ReadFile(cfg.PopsFile); err != nil || string(saved) != testPops {
+		t.Errorf("expected the list to be saved got %q %v", saved, err)
+	}
+
+	// At startup the saved list is used when POPS_URL fails.
+	atomic.StoreInt64(&ps.failing, 1)
+	loaded, fresh, err := getServers(zerolog.Nop(), cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh {
+		t.Error("expected the saved list not to be fresh")
+	}
+	if names(loaded) != names(fetched) {
+		t.Errorf("expected %s got %s", names(fetched), names(loaded))
+	}
+
+	// Later the current list is kept instead.
+	if _, _, err := getServers(zerolog.Nop(), cfg, nil, loaded); err == nil {
+		t.Error("expected an error when refreshing")
+	}
+}
+
+func TestDNSFallback(t *testing.T) {
+	s := &server{IP: "127.0.0.1", Stats: newStats(), Breaker: breaker.New()}
+	for i := 0; i < 5; i++ {
+		s.Breaker.Record(false)
+	}
+
+	for _, dnsFallback := range []bool{true, false} {
+		f := &ipApi{
+			clients:     make(map[string]*fasthttp.HostClient),
+			balance:     balanceBest,
+			servers:     []*server{s},
+			dnsFallback: dnsFallback,
+		}
+
+		// The only PoP has an open breaker.
+		server, client, err := f.getBatchServerAndClient(nil)
+		if server != nil {
+			t.Errorf("%t: expected no server got %s", dnsFallback, server.name())
+		}
+		if dnsFallback && (err != nil || client == nil) {
+			t.Errorf("expected a client for DNS got %v", err)
+		}
+		if !dnsFallback && (err != ErrNoPop || client != nil) {
+			t.Errorf("expected %v got %v", ErrNoPop, err)
+		}
+	}
+}
+
+// probeTarget is a local TLS server PoPs are probed at. Connections to 127.0.0.1:443 go to it
+// through an HTTP CONNECT proxy, connections to other IPs are closed right away.
+type probeTarget struct {
+	dialer     *egress.Dialer
+	connects   int64        // Only accessed atomically.
+	serverName atomic.Value // Of the last handshake.
+}
+
+func newProbeTarget(t *testing.T) *probeTarget {
+	p := &probeTarget{}
+
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			p.serverName.Store(hello.ServerName)
+			return nil, nil
+		},
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				atomic.AddInt64(&p.connects, 1)
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+				if req.Host != "127.0.0.1:443" {
+					return
+				}
+				upstream, err := net.Dial("tcp", ts.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	if p.dialer, err = egress.New("http://" + l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server's certificate isn't for pro.ip-api.com.
+	tlsConfig := upstreamTLSConfig
+	upstreamTLSConfig = &tls.Config{ServerName: upstreamHost, InsecureSkipVerify: true}
+	t.Cleanup(func() {
+		upstreamTLSConfig = tlsConfig
+	})
+
+	return p
+}
+
+func TestHandshake(t *testing.T) {
+	p := newProbeTarget(t)
+
+	connect, tlsHandshake, err := handshake(p.dialer, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connect <= 0 || tlsHandshake <= 0 {
+		t.Errorf("expected both times to be measured got %s and %s", connect, tlsHandshake)
+	}
+	if name, _ := p.serverName.Load().(string); name != upstreamHost {
+		t.Errorf("expected the handshake for %s got %q", upstreamHost, name)
+	}
+
+	if _, _, err := handshake(p.dialer, "127.0.0.2"); err == nil {
+		t.Error("expected the handshake with a closed connection to fail")
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	p := newProbeTarget(t)
+
+	connect, tlsHandshake, err := measure(p.dialer, "127.0.0.1")
+	if err != nil || connect <= 0 || tlsHandshake <= 0 {
+		t.Errorf("expected both times to be measured got %s and %s: %v", connect, tlsHandshake, err)
+	}
+	if n := atomic.LoadInt64(&p.connects); n != probeHandshakes {
+		t.Errorf("expected %d handshakes got %d", probeHandshakes, n)
+	}
+
+	if _, _, err := measure(p.dialer, "127.0.0.2"); err == nil {
+		t.Error("expected an error when all handshakes fail")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	p := newProbeTarget(t)
+
+	tests := []struct {
+		name     string
+		ip       string
+		idle     bool
+		connects int64
+		success  float64
+		measured bool
+	}{
+		{"idle", "127.0.0.1", true, probeHandshakes, 1, true},
+		{"busy", "127.0.0.1", false, 0, 1, false},
+		// A failed probe counts as a failed request.
+		{"failing", "127.0.0.2", true, probeHandshakes, 0.9, false},
+	}
+
+	for _, test := range tests {
+		s := &server{IP: test.ip, Stats: newStats()}
+		if !test.idle {
+			s.Stats.observe(time.Millisecond*100, true)
+		}
+		connects := atomic.LoadInt64(&p.connects)
+
+		probe(zerolog.Nop(), p.dialer, s)
+
+		if n := atomic.LoadInt64(&p.connects) - connects; n != test.connects {
+			t.Errorf("%s: expected %d connections got %d", test.name, test.connects, n)
+		}
+		if !near(s.Stats.success, test.success) {
+			t.Errorf("%s: expected success rate %v got %v", test.name, test.success, s.Stats.success)
+		}
+		if measured := s.Stats.connect > 0 && s.Stats.handshake > 0; measured != test.measured {
+			t.Errorf("%s: expected the times to be measured %t", test.name, test.measured)
+		}
+		// Probes don't change the latency of requests.
+		expected := time.Millisecond * 100
+		if test.idle {
+			expected = 0
+		}
+		if time.Duration(s.Stats.latency) != expected {
+			t.Errorf("%s: expected latency %s got %s", test.name, expected, time.Duration(s.Stats.latency))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ip-api/proxy/internal/util"
+)
+
+const (
+	// Weight of a new measurement in the moving averages.
+	latencyAlpha = 0.2
+	successAlpha = 0.1
+
+	// PoPs without requests for this long are probed.
+	probeIdle = time.Minute
+)
+
+// stats keeps moving averages of the latency and success rate of requests to a PoP.
+// The times measured by probes are kept separately, they are a lot shorter than requests.
+type stats struct {
+	flight int64 // Requests in flight, only accessed atomically.
+
+	mu        sync.Mutex
+	latency   float64 // Nanoseconds.
+	success   float64
+	last      time.Time // Of the last request.
+	connect   float64   // Nanoseconds, measured by probes.
+	handshake float64   // Nanoseconds, measured by probes.
+	probed    time.Time
+
+	recent latencies
+}
+
+func newStats() *stats {
+	return &stats{
+		success: 1,
+	}
+}
+
+// observe records a request which took d. The latency of failed requests isn't used.
+func (s *stats) observe(d time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	success := 0.0
+	if ok {
+		success = 1
+
+		s.latency = ewma(s.latency, d)
+		s.recent.add(d)
+	}
+	s.success += successAlpha * (success - s.success)
+	s.last = util.Now()
+}
+
+// start is called when a request is sent, done when it's done.
+func (s *stats) start() {
+	atomic.AddInt64(&s.flight, 1)
+}
+
+func (s *stats) done() {
+	atomic.AddInt64(&s.flight, -1)
+}
+
+func (s *stats) inFlight() int64 {
+	return atomic.LoadInt64(&s.flight)
+}
+
+// observeProbe records a probe which connected in connect and did the TLS handshake in handshake.
+// A failed probe counts as a failed request, the times don't change the latency of requests.
+func (s *stats) observeProbe(connect, handshake time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	success := 0.0
+	if ok {
+		success = 1
+
+		s.connect = ewma(s.connect, connect)
+		s.handshake = ewma(s.handshake, handshake)
+	}
+	s.success += successAlpha * (success - s.success)
+	s.probed = util.Now()
+}
+
+// ewma returns the moving average avg with d added.
+func ewma(avg float64, d time.Duration) float64 {
+	if avg == 0 {
+		return float64(d)
+	}
+	return avg + latencyAlpha*(float64(d)-avg)
+}
+
+// score is used to rank PoPs, lower is better. PoPs which fail are ranked as if they were slower.
+// Idle PoPs are ranked by the connect time of their probes times probeScale, see rank, so they
+// don't look faster than PoPs which get requests.
+func (s *stats) score(probeScale float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	latency := s.latency
+	if s.connect > 0 && (latency == 0 || util.Now().Sub(s.last) >= probeIdle) {
+		latency = s.connect * probeScale
+	}
+
+	if latency == 0 {
+		// Never measured.
+		return math.MaxFloat64
+	}
+	return latency / math.Max(s.success, 0.05)
+}
+
+// requestsPerConnect returns how many times longer requests take than connecting,
+// or 0 if either isn't known.
+func (s *stats) requestsPerConnect() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.latency == 0 || s.connect == 0 {
+		return 0
+	}
+	return s.latency / s.connect
+}
+
+// idle returns true if there were no requests for probeIdle.
+func (s *stats) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return util.Now().Sub(s.last) >= probeIdle
+}
+
+// MarshalJSON is used to show the stats on /debug.
+func (s *stats) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	v := map[string]interface{}{
+		"latency_ms":   ms(s.latency),
+		"connect_ms":   ms(s.connect),
+		"handshake_ms": ms(s.handshake),
+		"success_rate": math.Round(s.success*1000) / 1000,
+		"last":         s.last,
+		"probed":       s.probed,
+		"in_flight":    s.inFlight(),
+	}
+	s.mu.Unlock()
+
+	if sorted := s.recent.sorted(); len(sorted) > 0 {
+		for _, p := range []int{50, 90, 99} {
+			v["p"+strconv.Itoa(p)+"_ms"] = ms(float64(sorted[len(sorted)*p/100]))
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+// ms converts nanoseconds to milliseconds rounded to one decimal.
+func ms(ns float64) float64 {
+	return math.Round(ns/float64(time.Millisecond)*10) / 10
+}
@@ -0,0 +1,212 @@
+package fetcher
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// observation is a request to a PoP which took d.
+type observation struct {
+	d  time.Duration
+	ok bool
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name         string
+		observations []observation
+		latency      time.Duration
+		success      float64
+		score        float64
+	}{
+		{"never measured", nil, 0, 1, math.MaxFloat64},
+		{"first request", []observation{{time.Millisecond * 100, true}}, time.Millisecond * 100, 1, float64(time.Millisecond * 100)},
+		// 100ms + 0.2 * (200ms - 100ms)
+		{"moving average", []observation{{time.Millisecond * 100, true}, {time.Millisecond * 200, true}}, time.Millisecond * 120, 1, float64(time.Millisecond * 120)},
+		// The latency of a failed request isn't used, the success rate drops by 0.1 and the score goes up.
+		{"failed request", []observation{{time.Millisecond * 100, true}, {time.Second * 5, false}}, time.Millisecond * 100, 0.9, float64(time.Millisecond*100) / 0.9},
+		// 0.9 + 0.1 * (1 - 0.9)
+		{"recovering", []observation{{time.Millisecond * 100, true}, {time.Second * 5, false}, {time.Millisecond * 100, true}}, time.Millisecond * 100, 0.91, float64(time.Millisecond*100) / 0.91},
+		// Only failures were seen, so there is no latency to rank by.
+		{"only failures", []observation{{time.Second, false}, {time.Second, false}}, 0, 0.81, math.MaxFloat64},
+	}
+
+	for _, test := range tests {
+		s := newStats()
+		for _, o := range test.observations {
+			s.observe(o.d, o.ok)
+		}
+
+		if time.Duration(s.latency) != test.latency {
+			t.Errorf("%s: expected latency %s got %s", test.name, test.latency, time.Duration(s.latency))
+		}
+		if !near(s.success, test.success) {
+			t.Errorf("%s: expected success rate %v got %v", test.name, test.success, s.success)
+		}
+		if score := s.score(1); !near(score, test.score) {
+			t.Errorf("%s: expected score %v got %v", test.name, test.score, score)
+		}
+	}
+}
+
+func TestScoreMinSuccess(t *testing.T) {
+	s := newStats()
+	s.observe(time.Millisecond*100, true)
+	for i := 0; i < 100; i++ {
+		s.observe(time.Second, false)
+	}
+
+	// A PoP which always fails is ranked as if it were 20 times slower, not infinitely slow.
+	if score, expected := s.score(1), float64(time.Millisecond*100)/0.05; !near(score, expected) {
+		t.Errorf("expected score %v got %v", expected, score)
+	}
+}
+
+func TestRank(t *testing.T) {
+	type pop struct {
+		name         string
+		pin          int
+		observations []observation
+	}
+
+	fast := []observation{{time.Millisecond * 10, true}}
+	slow := []observation{{time.Millisecond * 50, true}}
+	// 10ms with a success rate of 0.9 * 0.9 = 0.81 scores 12.3ms.
+	fastFailing := []observation{{time.Millisecond * 10, true}, {time.Second, false}, {time.Second, false}}
+	// 10ms with a success rate of 0.9^20 = 0.12 scores 82ms.
+	fastBroken := append([]observation{{time.Millisecond * 10, true}}, make([]observation, 20)...)
+
+	tests := []struct {
+		name     string
+		pops     []pop
+		expected []string
+	}{
+		{"by latency", []pop{{"slow", 0, slow}, {"fast", 0, fast}}, []string{"fast", "slow"}},
+		{"never measured last", []pop{{"new", 0, nil}, {"slow", 0, slow}}, []string{"slow", "new"}},
+		{"failures rank lower", []pop{{"failing", 0, fastFailing}, {"fast", 0, fast}}, []string{"fast", "failing"}},
+		{"failures are worth some latency", []pop{{"slow", 0, slow}, {"failing", 0, fastFailing}}, []string{"failing", "slow"}},
+		{"many failures rank below slow", []pop{{"broken", 0, fastBroken}, {"slow", 0, slow}}, []string{"slow", "broken"}},
+		{"ties keep their order", []pop{{"b", 0, fast}, {"a", 0, fast}}, []string{"b", "a"}},
+		{"pinned first in pin order", []pop{{"fast", 0, fast}, {"pin2", 2, fast}, {"pin1", 1, slow}}, []string{"pin1", "pin2", "fast"}},
+		{"pinned even if failing", []pop{{"fast", 0, fast}, {"pin", 1, fastBroken}}, []string{"pin", "fast"}},
+	}
+
+	for _, test := range tests {
+		servers := make([]*server, 0, len(test.pops))
+		for _, p := range test.pops {
+			s := &server{Pop: p.name, Pin: p.pin, Stats: newStats()}
+			for _, o := range p.observations {
+				s.Stats.observe(o.d, o.ok)
+			}
+			servers = append(servers, s)
+		}
+
+		rank(servers)
+
+		ranked := make([]string, 0, len(servers))
+		for _, s := range servers {
+			ranked = append(ranked, s.Pop)
+		}
+		if !reflect.DeepEqual(ranked, test.expected) {
+			t.Errorf("%s: expected %v got %v", test.name, test.expected, ranked)
+		}
+	}
+}
+
+func TestProbeScore(t *testing.T) {
+	currentTime := time.Date(2020, 1, 30, 12, 0, 0, 0, time.UTC)
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	// Requests take 4 times longer than connecting.
+	const scale = 4
+
+	tests := []struct {
+		name    string
+		request time.Duration // 0 for none.
+		connect time.Duration // 0 for no probe.
+		idle    bool
+		score   time.Duration
+	}{
+		{"only requests", time.Millisecond * 100, 0, false, time.Millisecond * 100},
+		// A probe doesn't pull the latency of a busy PoP down to its connect time.
+		{"busy", time.Millisecond * 100, time.Millisecond * 20, false, time.Millisecond * 100},
+		{"only probed", 0, time.Millisecond * 20, true, time.Millisecond * 80},
+		// An idle PoP is ranked by its current connect time instead of old requests.
+		{"idle", time.Millisecond * 100, time.Millisecond * 20, true, time.Millisecond * 80},
+		{"idle without probes", time.Millisecond * 100, 0, true, time.Millisecond * 100},
+	}
+
+	for _, test := range tests {
+		s := newStats()
+		if test.request > 0 {
+			s.observe(test.request, true)
+		}
+		if test.idle {
+			currentTime = currentTime.Add(probeIdle)
+		}
+		if test.connect > 0 {
+			s.observeProbe(test.connect, test.connect*2, true)
+		}
+
+		if score := s.score(scale); !near(score, float64(test.score)) {
+			t.Errorf("%s: expected score %s got %s", test.name, test.score, time.Duration(score))
+		}
+	}
+}
+
+func TestRankProbed(t *testing.T) {
+	currentTime := time.Date(2020, 1, 30, 12, 0, 0, 0, time.UTC)
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	// Two busy PoPs where requests take 4 and 6 times longer than connecting, the median is 6.
+	newBusy := func(name string, request, connect time.Duration) *server {
+		s := &server{Pop: name, Stats: newStats()}
+		s.Stats.observeProbe(connect, connect, true)
+		s.Stats.observe(request, true)
+		return s
+	}
+	a := newBusy("a", time.Millisecond*100, time.Millisecond*25)
+	b := newBusy("b", time.Millisecond*120, time.Millisecond*20)
+
+	tests := []struct {
+		connect  time.Duration
+		expected []string
+	}{
+		// 15ms connect scales to 90ms.
+		{time.Millisecond * 15, []string{"idle", "a", "b"}},
+		// 18ms connect scales to 108ms, it would rank first by its connect time alone.
+		{time.Millisecond * 18, []string{"a", "idle", "b"}},
+		{time.Millisecond * 25, []string{"a", "b", "idle"}},
+	}
+
+	for _, test := range tests {
+		idle := &server{Pop: "idle", Stats: newStats()}
+		idle.Stats.observeProbe(test.connect, test.connect, true)
+
+		servers := []*server{b, idle, a}
+		rank(servers)
+
+		ranked := []string{servers[0].Pop, servers[1].Pop, servers[2].Pop}
+		if !reflect.DeepEqual(ranked, test.expected) {
+			t.Errorf("%s: expected %v got %v", test.connect, test.expected, ranked)
+		}
+	}
+}
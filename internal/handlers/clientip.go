@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	strForwarded     = []byte("Forwarded")
+	strXForwardedFor = []byte("X-Forwarded-For")
+	strXRealIP       = []byte("X-Real-IP")
+)
+
+func (h Handler) trusted(ip net.IP) bool {
+	for _, n := range h.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client that made the request.
+// If the request was made by a trusted proxy the client IP is taken from
+// the X-Forwarded-For, X-Real-IP or Forwarded header, in that order.
+func (h Handler) clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	remote := ctx.RemoteIP()
+	if !h.trusted(remote) {
+		return remote
+	}
+
+	if v := ctx.Request.Header.PeekBytes(strXForwardedFor); len(v) > 0 {
+		if ip := h.lastUntrusted(bytes.Split(v, []byte(","))); ip != nil {
+			return ip
+		}
+	}
+
+	if v := ctx.Request.Header.PeekBytes(strXRealIP); len(v) > 0 {
+		if ip := net.ParseIP(string(bytes.TrimSpace(v))); ip != nil {
+			return ip
+		}
+	}
+
+	if v := ctx.Request.Header.PeekBytes(strForwarded); len(v) > 0 {
+		if ip := h.lastUntrusted(forwardedFor(v)); ip != nil {
+			return ip
+		}
+	}
+
+	return remote
+}
+
+// lastUntrusted walks the chain of proxies from the closest to the furthest
+// and returns the first IP that isn't a trusted proxy.
+// If all of them are trusted the furthest is returned.
+func (h Handler) lastUntrusted(chain [][]byte) net.IP {
+	var ip net.IP
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		parsed := net.ParseIP(string(bytes.TrimSpace(chain[i])))
+		if parsed == nil {
+			// We can't trust anything added before an invalid entry.
+			break
+		}
+
+		ip = parsed
+		if !h.trusted(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the addresses in the for= parameters of a Forwarded header with ports removed.
+// See: https://tools.ietf.org/html/rfc7239
+func forwardedFor(header []byte) [][]byte {
+	var addrs [][]byte
+
+	for _, element := range bytes.Split(header, []byte(",")) {
+		for _, pair := range bytes.Split(element, []byte(";")) {
+			pair = bytes.TrimSpace(pair)
+			if len(pair) < 4 || !bytes.EqualFold(pair[:4], []byte("for=")) {
+				continue
+			}
+
+			addr := bytes.Trim(pair[4:], `"`)
+			if len(addr) > 0 && addr[0] == '[' {
+				// [2001:db8:cafe::17]:4711
+				if end := bytes.IndexByte(addr, ']'); end > 0 {
+					addr = addr[1:end]
+				}
+			} else if i := bytes.IndexByte(addr, ':'); i >= 0 && bytes.Count(addr, []byte(":")) == 1 {
+				// 192.0.2.43:47011
+				addr = addr[:i]
+			}
+
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"strconv"
+
+	"github.com/ip-api/proxy/internal/structs"
+)
+
+var (
+	strApplicationJavascript = []byte("application/javascript; charset=utf-8")
+	strApplicationXml        = []byte("application/xml; charset=utf-8")
+	strTextCsv               = []byte("text/csv; charset=utf-8")
+	strTextPlain             = []byte("text/plain; charset=utf-8")
+)
+
+// format serializes a single response in one of the non JSON formats ip-api.com supports.
+type format struct {
+	contentType []byte
+	write       func(buf *bytes.Buffer, values []structs.Value)
+}
+
+var (
+	formatXml = format{
+		contentType: strApplicationXml,
+		write:       writeXml,
+	}
+	formatCsv = format{
+		contentType: strTextCsv,
+		write:       writeCsv,
+	}
+	formatLine = format{
+		contentType: strTextPlain,
+		write:       writeLine,
+	}
+	formatPhp = format{
+		contentType: strTextPlain,
+		write:       writePhp,
+	}
+)
+
+// valueString formats a value the way ip-api.com does in its text based formats.
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func writeXml(buf *bytes.Buffer, values []structs.Value) {
+	buf.WriteString(xml.Header)
+	buf.WriteString("<query>\n")
+	for _, v := range values {
+		buf.WriteString("  <")
+		buf.WriteString(v.Name)
+		buf.WriteString(">")
+		xml.EscapeText(buf, []byte(valueString(v.Value)))
+		buf.WriteString("</")
+		buf.WriteString(v.Name)
+		buf.WriteString(">\n")
+	}
+	buf.WriteString("</query>\n")
+}
+
+func writeCsv(buf *bytes.Buffer, values []structs.Value) {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = valueString(v.Value)
+	}
+
+	w := csv.NewWriter(buf)
+	w.Write(record)
+	w.Flush()
+}
+
+func writeLine(buf *bytes.Buffer, values []structs.Value) {
+	for _, v := range values {
+		buf.WriteString(valueString(v.Value))
+		buf.WriteByte('\n')
+	}
+}
+
+// writePhp writes values as a serialized PHP associative array.
+// See: https://www.php.net/manual/en/function.serialize.php
+func writePhp(buf *bytes.Buffer, values []structs.Value) {
+	phpString := func(s string) {
+		buf.WriteString("s:")
+		buf.WriteString(strconv.Itoa(len(s)))
+		buf.WriteString(`:"`)
+		buf.WriteString(s)
+		buf.WriteString(`";`)
+	}
+
+	buf.WriteString("a:")
+	buf.WriteString(strconv.Itoa(len(values)))
+	buf.WriteString(":{")
+	for _, v := range values {
+		phpString(v.Name)
+
+		switch value := v.Value.(type) {
+		case string:
+			phpString(value)
+		case float64:
+			buf.WriteString("d:")
+			buf.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+			buf.WriteString(";")
+		case int:
+			buf.WriteString("i:")
+			buf.WriteString(strconv.Itoa(value))
+			buf.WriteString(";")
+		case bool:
+			if value {
+				buf.WriteString("b:1;")
+			} else {
+				buf.WriteString("b:0;")
+			}
+		}
+	}
+	buf.WriteString("}")
+}
+
+// validCallback reports if name is a safe JSONP callback name
+// such as "callback", "$jsonp_1" or "jQuery.callbacks.cb1".
+func validCallback(name string) bool {
+	if len(name) == 0 || len(name) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' {
+			continue
+		}
+		if i > 0 && (c >= '0' && c <= '9' || c == '.' && name[i-1] != '.') {
+			continue
+		}
+		return false
+	}
+
+	return name[len(name)-1] != '.'
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/mailru/easyjson"
 	"github.com/mailru/easyjson/jwriter"
@@ -13,10 +14,17 @@ import (
 	"github.com/valyala/fasthttp"
 
 	"github.com/ip-api/proxy/internal/batch"
+	"github.com/ip-api/proxy/internal/budget"
 	"github.com/ip-api/proxy/internal/cache"
 	"github.com/ip-api/proxy/internal/fetcher"
 	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/ratelimit"
+	"github.com/ip-api/proxy/internal/resolve"
+	"github.com/ip-api/proxy/internal/special"
 	"github.com/ip-api/proxy/internal/structs"
+	"github.com/ip-api/proxy/internal/tenant"
+	"github.com/ip-api/proxy/internal/trace"
 	"github.com/ip-api/proxy/internal/util"
 	"github.com/ip-api/proxy/internal/wait"
 )
@@ -26,17 +34,35 @@ var (
 	strAccessControlAllowMethods              = []byte("Access-Control-Allow-Methods")
 	strAccessControlAllowOrigin               = []byte("Access-Control-Allow-Origin")
 	strApplicationJson                        = []byte("application/json")
+	strBearer                                 = []byte("Bearer ")
 	strCacheControl                           = []byte("Cache-Control")
 	strContentType                            = []byte("Content-Type")
 	strContentTypeContentLengthAcceptEncoding = []byte("Content-Type, Content-Length, Accept-Encoding")
+	strNoStore                                = []byte("no-store")
 	strOPTIONS                                = []byte("OPTIONS")
 	strPostGetOptions                         = []byte("POST, GET, OPTIONS")
 	strSlashBatch                             = []byte("/batch")
+	strSlashCsv                               = []byte("/csv")
+	strSlashCsvSlash                          = []byte("/csv/")
 	strSlashDebug                             = []byte("/debug")
+	strSlashHealthz                           = []byte("/healthz")
+	strSlashMetrics                           = []byte("/metrics")
 	strSlashPing                              = []byte("/ping")
 	strSlashJson                              = []byte("/json")
 	strSlashJsonSlash                         = []byte("/json/")
+	strSlashLine                              = []byte("/line")
+	strSlashLineSlash                         = []byte("/line/")
+	strSlashPhp                               = []byte("/php")
+	strSlashPhpSlash                          = []byte("/php/")
+	strSlashReadyz                            = []byte("/readyz")
+	strSlashXml                               = []byte("/xml")
+	strSlashXmlSlash                          = []byte("/xml/")
 	strStar                                   = []byte("*")
+	strStale                                  = []byte("STALE")
+	strXCache                                 = []byte("X-Cache")
+	strXRl                                    = []byte("X-Rl")
+	strXTtl                                   = []byte("X-Ttl")
+	strXSource                                = []byte("X-Source")
 	strYesEverything                          = []byte("public, max-age=1800")
 )
 
@@ -53,26 +79,207 @@ var languages = map[string]struct{}{
 
 const defaultLanguage = "en"
 
+var (
+	metricRequests = metrics.NewCounterVec("ipapi_proxy_http_requests_total", "Number of HTTP requests per route and status code.", "route", "code")
+	metricDuration = metrics.NewHistogramVec(
+		"ipapi_proxy_http_request_duration_seconds",
+		"Duration of HTTP requests per route.",
+		[]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		"route",
+	)
+	metricSpecial = metrics.NewCounterVec("ipapi_proxy_special_responses_total", "Number of private and reserved IPs answered without an upstream request.", "message")
+	metricTenants = metrics.NewCounterVec("ipapi_proxy_tenant_requests_total", "Number of requests per tenant, rejected requests have an empty tenant.", "tenant")
+)
+
 type Handler struct {
 	Logger  zerolog.Logger
 	Cache   *cache.Cache
 	Batches *batch.Batches
 	Client  fetcher.Client
+
+	// Resolver is used to resolve hostname queries, if nil only IPs are accepted.
+	Resolver resolve.Resolver
+
+	// Requests from these networks are allowed to set the client IP
+	// using the X-Forwarded-For, X-Real-IP or Forwarded header.
+	TrustedProxies []*net.IPNet
+
+	// If not nil lookups require the key of an enabled tenant.
+	Tenants *tenant.Tenants
+
+	// If not nil lookups are rate limited per tenant, or per client IP without tenants.
+	Limiter *ratelimit.Limiter
+
+	// Budget is shown on /debug, it can be nil.
+	Budget *budget.Budget
+}
+
+// lookup is an entry to look up.
+type lookup struct {
+	ip     string
+	lang   string
+	fields field.Fields
+}
+
+// limit takes the lookups from the rate limit of the client, split into cache hits and fetches.
+// It sets the X-Rl and X-Ttl headers like ip-api.com and returns the error message with a 429 status
+// if the client is over the limit. A batch that needs more entries than the limit is rejected
+// with a 429 status as well, but without X-Ttl as it would never be allowed.
+func (h Handler) limit(ctx *fasthttp.RequestCtx, span *trace.Span, t *tenant.Tenant, lookups []lookup) string {
+	if h.Limiter == nil {
+		return ""
+	}
+
+	var hits, fetches int
+	for _, l := range lookups {
+		if h.Batches.Cached(l.ip, l.lang, l.fields) {
+			hits++
+		} else {
+			fetches++
+		}
+	}
+
+	var key string
+	if t != nil {
+		key = "tenant:" + t.Name
+	} else {
+		key = h.clientIP(ctx).String()
+	}
+
+	result := h.Limiter.Allow(key, hits, fetches)
+
+	ctx.Response.Header.SetCanonical(strXRl, []byte(strconv.Itoa(result.Remaining)))
+
+	if result.TooLarge {
+		span.SetAttribute("rate_limited", true)
+		ctx.Response.SetStatusCode(fasthttp.StatusTooManyRequests)
+		return "batch larger than the rate limit"
+	}
+
+	ttl := int((result.Reset + time.Second - 1) / time.Second)
+	ctx.Response.Header.SetCanonical(strXTtl, []byte(strconv.Itoa(ttl)))
+
+	if !result.Allowed {
+		span.SetAttribute("rate_limited", true)
+		ctx.Response.SetStatusCode(fasthttp.StatusTooManyRequests)
+		return "too many requests"
+	}
+
+	return ""
 }
 
-func (h Handler) writeResponse(ctx *fasthttp.RequestCtx, response easyjson.Marshaler) {
+// authenticate returns the tenant of the request, which is nil if authentication is disabled.
+// The key is passed in the key parameter or the Authorization header, with or without "Bearer ".
+func (h Handler) authenticate(ctx *fasthttp.RequestCtx, span *trace.Span) (*tenant.Tenant, error) {
+	if h.Tenants == nil {
+		return nil, nil
+	}
+
+	key := ctx.QueryArgs().Peek("key")
+	if len(key) == 0 {
+		key = ctx.Request.Header.Peek("Authorization")
+		if len(key) > len(strBearer) && bytes.EqualFold(key[:len(strBearer)], strBearer) {
+			key = key[len(strBearer):]
+		}
+	}
+
+	t, err := h.Tenants.Authenticate(string(key))
+	if err != nil {
+		metricTenants.With("").Inc()
+		ctx.Response.SetStatusCode(fasthttp.StatusForbidden)
+		return nil, err
+	}
+
+	metricTenants.With(t.Name).Inc()
+	span.SetAttribute("tenant", t.Name)
+
+	return t, nil
+}
+
+// writeResponse writes response as JSON, or as JSONP if callback isn't empty.
+func (h Handler) writeResponse(ctx *fasthttp.RequestCtx, callback string, response easyjson.Marshaler) {
+	if callback != "" {
+		ctx.Response.Header.SetCanonical(strContentType, strApplicationJavascript)
+		ctx.WriteString(callback)
+		ctx.WriteString("(")
+	}
+
 	jw := &jwriter.Writer{}
 	response.MarshalEasyJSON(jw)
 	if _, err := jw.DumpTo(ctx); err != nil {
 		h.Logger.Error().Err(err).Msg("failed to write response")
 	}
+
+	if callback != "" {
+		ctx.WriteString(");")
+	}
+}
+
+// writeFormat writes response in format f, or as JSON(P) if f is nil.
+func (h Handler) writeFormat(ctx *fasthttp.RequestCtx, f *format, callback string, response structs.Response) {
+	if f == nil {
+		h.writeResponse(ctx, callback, response)
+		return
+	}
+
+	ctx.Response.Header.SetCanonical(strContentType, f.contentType)
+
+	var buf bytes.Buffer
+	f.write(&buf, response.Values())
+	if _, err := ctx.Write(buf.Bytes()); err != nil {
+		h.Logger.Error().Err(err).Msg("failed to write response")
+	}
+}
+
+// callback returns the JSONP callback of the request and false if it is invalid.
+func callback(qa *fasthttp.Args) (string, bool) {
+	callback := string(qa.Peek("callback"))
+	if callback != "" && !validCallback(callback) {
+		return "", false
+	}
+	return callback, true
+}
+
+// lookupQuery returns the IP to look up for a query, which is either an IP or a hostname.
+// Just like ip-api.com hostnames are resolved to a single IP which is then used as query.
+func (h Handler) lookupQuery(query string) (string, net.IP, bool) {
+	if ip := net.ParseIP(query); ip != nil {
+		return query, ip, true
+	}
+
+	if h.Resolver == nil || !resolve.ValidHostname(query) {
+		return "", nil, false
+	}
+
+	ip, err := h.Resolver.Resolve(query)
+	if err != nil {
+		h.Logger.Debug().Err(err).Str("host", query).Msg("failed to resolve")
+		return "", nil, false
+	}
+
+	return ip.String(), ip, true
+}
+
+// specialResponse returns the response ip-api.com returns for private and reserved IPs.
+func specialResponse(ip, message string) structs.Response {
+	metricSpecial.With(message).Inc()
+
+	r := structs.ErrorResponse("fail", message)
+	r.Query = &ip
+	return r
 }
 
 // /json/{query}
+// /xml/{query}
+// /csv/{query}
+// /line/{query}
+// /php/{query}
 //   ?fields=<bitmap | comma separated list>
 //   ?lang=<lang>
-//   ?callback=<function name>
-func (h Handler) single(ctx *fasthttp.RequestCtx) {
+//   ?callback=<function name> (json only)
+//
+// f is nil for JSON.
+func (h Handler) single(ctx *fasthttp.RequestCtx, span *trace.Span, f *format) {
 	path := ctx.Path()
 	qa := ctx.QueryArgs()
 
@@ -86,44 +293,77 @@ func (h Handler) single(ctx *fasthttp.RequestCtx) {
 		fields = field.FromCSV(fieldsStr)
 	}
 
+	var cb string
+	if f == nil {
+		var ok bool
+		if cb, ok = callback(qa); !ok {
+			h.writeResponse(ctx, "", structs.ErrorResponse("fail", "invalid callback").Trim(fields))
+			return
+		}
+	}
+
+	t, err := h.authenticate(ctx, span)
+	if err != nil {
+		h.writeFormat(ctx, f, cb, structs.ErrorResponse("fail", err.Error()).Trim(fields))
+		return
+	}
+	fields = t.Strip(fields)
+
 	lang := string(qa.Peek("lang"))
 	if lang == "" {
 		lang = defaultLanguage
-	} else if _, ok := languages[lang]; !ok {
-		h.writeResponse(ctx, structs.ErrorResponse("fail", "invalid language").Trim(fields))
+	}
+	if _, ok := languages[lang]; !ok || !t.AllowsLanguage(lang) {
+		h.writeFormat(ctx, f, cb, structs.ErrorResponse("fail", "invalid language").Trim(fields))
 		return
 	}
 
-	if len(path) <= len(strSlashJsonSlash) {
-		r, err := h.Client.FetchSelf(lang, fields)
-		if err != nil {
-			h.writeResponse(ctx, structs.ErrorResponse("fail", "error in upstream").Trim(fields))
-			return
-		}
+	// Everything after the second slash is the query: /json/{query}
+	var query string
+	if i := bytes.IndexByte(path[1:], '/'); i >= 0 && len(path) > i+2 {
+		query = string(path[i+2:])
+	} else {
+		// Without a query we look up the IP of the client.
+		query = h.clientIP(ctx).String()
+	}
 
-		h.writeResponse(ctx, r.Trim(fields))
+	ip, parsed, ok := h.lookupQuery(query)
+	if !ok {
+		h.writeFormat(ctx, f, cb, structs.ErrorResponse("fail", "invalid query").Trim(fields))
 		return
 	}
 
-	ip := string(path[len(strSlashJsonSlash):])
+	if message, ok := special.Lookup(parsed); ok {
+		h.writeFormat(ctx, f, cb, specialResponse(ip, message).Trim(fields))
+		return
+	}
 
-	if net.ParseIP(ip) == nil {
-		h.writeResponse(ctx, structs.ErrorResponse("fail", "invalid query").Trim(fields))
+	if message := h.limit(ctx, span, t, []lookup{{ip, lang, fields}}); message != "" {
+		h.writeFormat(ctx, f, cb, structs.ErrorResponse("fail", message).Trim(fields))
 		return
 	}
 
-	entry, c := h.Batches.Add(ip, lang, fields)
+	entry, c := h.Batches.Add(ip, lang, fields, span)
 
 	if c != nil {
 		// Wait for the entry to contain valid data.
 		<-c
 	}
 
-	h.writeResponse(ctx, entry.Response.Trim(fields))
+	if entry.Stale {
+		ctx.Response.Header.SetCanonical(strXCache, strStale)
+	}
+	if entry.Source != "" {
+		ctx.Response.Header.SetCanonical(strXSource, []byte(entry.Source))
+	}
+
+	h.writeFormat(ctx, f, cb, entry.Response.Trim(fields))
 }
 
 // /batch
 //   ?fields=<bitmap | comma separated list>
+//   ?lang=<lang>
+//   ?callback=<function name>
 // ["1.1.1.1"|
 // {
 //   "query": "IPv4/IPv6 required",
@@ -131,7 +371,7 @@ func (h Handler) single(ctx *fasthttp.RequestCtx) {
 //   "lang": "response language optional"
 // }
 // ]
-func (h Handler) batch(ctx *fasthttp.RequestCtx) {
+func (h Handler) batch(ctx *fasthttp.RequestCtx, span *trace.Span) {
 	qa := ctx.QueryArgs()
 
 	var defaultFields field.Fields
@@ -143,9 +383,26 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 		defaultFields = field.FromCSV(fieldsStr)
 	}
 
+	cb, ok := callback(qa)
+	if !ok {
+		h.writeResponse(ctx, "", structs.Responses{
+			structs.ErrorResponse("fail", "invalid callback").Trim(defaultFields),
+		})
+		return
+	}
+
+	t, err := h.authenticate(ctx, span)
+	if err != nil {
+		h.writeResponse(ctx, cb, structs.Responses{
+			structs.ErrorResponse("fail", err.Error()).Trim(defaultFields),
+		})
+		return
+	}
+	defaultFields = t.Strip(defaultFields)
+
 	var body []interface{}
 	if err := json.Unmarshal(ctx.PostBody(), &body); err != nil {
-		h.writeResponse(ctx, structs.Responses{
+		h.writeResponse(ctx, cb, structs.Responses{
 			structs.ErrorResponse("fail", "invalid body").Trim(defaultFields),
 		})
 		return
@@ -154,8 +411,9 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 	defaultLang := string(qa.Peek("lang"))
 	if defaultLang == "" {
 		defaultLang = defaultLanguage
-	} else if _, ok := languages[defaultLang]; !ok {
-		h.writeResponse(ctx, structs.Responses{
+	}
+	if _, ok := languages[defaultLang]; !ok || !t.AllowsLanguage(defaultLang) {
+		h.writeResponse(ctx, cb, structs.Responses{
 			structs.ErrorResponse("fail", "invalid language").Trim(defaultFields),
 		})
 		return
@@ -163,21 +421,24 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 
 	fields := make([]field.Fields, len(body))
 	entries := make([]*structs.CacheEntry, len(body))
-	w := wait.New()
+
+	// The entries to look up and their index in entries.
+	lookups := make([]lookup, 0, len(body))
+	indexes := make([]int, 0, len(body))
 
 	for i, part := range body {
 		var ip string
+		var parsed net.IP
 		var lang string
 
 		if ipStr, ok := part.(string); ok {
-			if net.ParseIP(ipStr) == nil {
+			if ip, parsed, ok = h.lookupQuery(ipStr); !ok {
 				fields[i] = defaultFields
 				entries[i] = &structs.CacheEntry{
 					Response: structs.ErrorResponse("fail", "invalid query"),
 				}
 				continue
 			} else {
-				ip = ipStr
 				lang = defaultLang
 				fields[i] = defaultFields
 			}
@@ -194,6 +455,7 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 				} else {
 					fields[i] = defaultFields
 				}
+				fields[i] = t.Strip(fields[i])
 			} else {
 				fields[i] = defaultFields
 			}
@@ -207,7 +469,7 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 					continue
 				}
 
-				if net.ParseIP(ip) == nil {
+				if ip, parsed, ok = h.lookupQuery(ip); !ok {
 					entries[i] = &structs.CacheEntry{
 						Response: structs.ErrorResponse("fail", "invalid query"),
 					}
@@ -224,7 +486,7 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 				lang, ok = langIf.(string)
 				if !ok {
 					lang = defaultLang
-				} else if _, ok := languages[lang]; !ok {
+				} else if _, ok := languages[lang]; !ok || !t.AllowsLanguage(lang) {
 					lang = defaultLang
 				}
 			} else {
@@ -232,8 +494,28 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 			}
 		}
 
-		entry, c := h.Batches.Add(ip, lang, fields[i])
-		entries[i] = entry
+		if message, ok := special.Lookup(parsed); ok {
+			entries[i] = &structs.CacheEntry{
+				Response: specialResponse(ip, message),
+			}
+			continue
+		}
+
+		lookups = append(lookups, lookup{ip, lang, fields[i]})
+		indexes = append(indexes, i)
+	}
+
+	if message := h.limit(ctx, span, t, lookups); message != "" {
+		h.writeResponse(ctx, cb, structs.Responses{
+			structs.ErrorResponse("fail", message).Trim(defaultFields),
+		})
+		return
+	}
+
+	w := wait.New()
+	for j, l := range lookups {
+		entry, c := h.Batches.Add(l.ip, l.lang, l.fields, span)
+		entries[indexes[j]] = entry
 		if c != nil {
 			w.Add(c)
 		}
@@ -243,24 +525,80 @@ func (h Handler) batch(ctx *fasthttp.RequestCtx) {
 
 	responses := make(structs.Responses, 0, len(entries))
 	for i, e := range entries {
+		if e.Stale {
+			ctx.Response.Header.SetCanonical(strXCache, strStale)
+		}
+		if e.Source != "" {
+			ctx.Response.Header.SetCanonical(strXSource, []byte(e.Source))
+		}
+
 		responses = append(responses, e.Response.Trim(fields[i]))
 	}
 
-	h.writeResponse(ctx, responses)
+	h.writeResponse(ctx, cb, responses)
 }
 
 func (h Handler) debug(ctx *fasthttp.RequestCtx) {
-	if err := json.NewEncoder(ctx).Encode(map[string]interface{}{
+	debug := map[string]interface{}{
 		"fetcher": h.Client.Debug(),
-	}); err != nil {
+	}
+	if h.Limiter != nil {
+		debug["ratelimit"] = h.Limiter.Debug()
+	}
+	if h.Budget != nil {
+		debug["budget"] = h.Budget.Debug()
+	}
+
+	if err := json.NewEncoder(ctx).Encode(debug); err != nil {
 		h.Logger.Error().Err(err).Msg("failed to write responses")
 	}
 }
 
+// /healthz reports if the proxy is alive and should not be restarted.
+func (h Handler) healthz(ctx *fasthttp.RequestCtx) {
+	h.writeHealth(ctx, h.Batches.Liveness())
+}
+
+// /readyz reports if the proxy can answer requests and should receive traffic.
+func (h Handler) readyz(ctx *fasthttp.RequestCtx) {
+	problems := h.Batches.Readiness()
+	problems = append(problems, h.Client.Readiness()...)
+
+	h.writeHealth(ctx, problems)
+}
+
+func (h Handler) writeHealth(ctx *fasthttp.RequestCtx, problems []string) {
+	// Health checks should never be cached.
+	ctx.Response.Header.SetCanonical(strCacheControl, strNoStore)
+
+	status := "ok"
+	if len(problems) > 0 {
+		status = "fail"
+		ctx.Response.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	} else {
+		problems = []string{}
+	}
+
+	if err := json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"status":   status,
+		"problems": problems,
+	}); err != nil {
+		h.Logger.Error().Err(err).Msg("failed to write health")
+	}
+}
+
 func (h Handler) ping(ctx *fasthttp.RequestCtx) {
 	fmt.Fprintf(ctx, "pong")
 }
 
+func (h Handler) metrics(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.SetContentType(metrics.ContentType)
+
+	if err := metrics.Default.Write(ctx); err != nil {
+		h.Logger.Error().Err(err).Msg("failed to write metrics")
+	}
+}
+
 func (h Handler) Index(ctx *fasthttp.RequestCtx) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -280,16 +618,56 @@ func (h Handler) Index(ctx *fasthttp.RequestCtx) {
 	}
 
 	path := ctx.Path()
+	start := time.Now()
+
+	parent, _ := trace.ParseTraceparent(string(ctx.Request.Header.Peek("traceparent")))
+	span := trace.Start("HTTP "+string(ctx.Method()), parent, trace.KindServer)
+	defer span.End()
 
+	var route string
 	if bytes.HasPrefix(path, strSlashJsonSlash) || bytes.Equal(path, strSlashJson) {
-		h.single(ctx)
+		route = "json"
+		h.single(ctx, span, nil)
+	} else if bytes.HasPrefix(path, strSlashXmlSlash) || bytes.Equal(path, strSlashXml) {
+		route = "xml"
+		h.single(ctx, span, &formatXml)
+	} else if bytes.HasPrefix(path, strSlashCsvSlash) || bytes.Equal(path, strSlashCsv) {
+		route = "csv"
+		h.single(ctx, span, &formatCsv)
+	} else if bytes.HasPrefix(path, strSlashLineSlash) || bytes.Equal(path, strSlashLine) {
+		route = "line"
+		h.single(ctx, span, &formatLine)
+	} else if bytes.HasPrefix(path, strSlashPhpSlash) || bytes.Equal(path, strSlashPhp) {
+		route = "php"
+		h.single(ctx, span, &formatPhp)
 	} else if bytes.Equal(path, strSlashBatch) {
-		h.batch(ctx)
+		route = "batch"
+		h.batch(ctx, span)
 	} else if bytes.Equal(path, strSlashDebug) {
+		route = "debug"
 		h.debug(ctx)
+	} else if bytes.Equal(path, strSlashHealthz) {
+		route = "healthz"
+		h.healthz(ctx)
+	} else if bytes.Equal(path, strSlashReadyz) {
+		route = "readyz"
+		h.readyz(ctx)
 	} else if bytes.Equal(path, strSlashPing) {
+		route = "ping"
 		h.ping(ctx)
+	} else if bytes.Equal(path, strSlashMetrics) {
+		route = "metrics"
+		h.metrics(ctx)
 	} else {
+		route = "notfound"
 		ctx.Response.SetStatusCode(fasthttp.StatusNotFound)
 	}
+
+	metricRequests.With(route, strconv.Itoa(ctx.Response.StatusCode())).Inc()
+	metricDuration.With(route).Observe(time.Since(start).Seconds())
+
+	span.SetName("HTTP " + string(ctx.Method()) + " /" + route)
+	span.SetAttribute("http.method", string(ctx.Method()))
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("http.status_code", ctx.Response.StatusCode())
 }
@@ -1,6 +1,7 @@
 package handlers_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/valyala/fasthttp"
@@ -20,6 +21,10 @@ func Test404(t *testing.T) {
 		"/jsons/",
 		"/batch/",
 		"/batchasd",
+		"/xmls",
+		"/csv2",
+		"/lines/",
+		"/phpinfo",
 	} {
 		t.Run(path, func(t *testing.T) {
 			ctx.Request.SetRequestURI(path)
@@ -30,3 +35,19 @@ func Test404(t *testing.T) {
 		})
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	h := handlers.Handler{}
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/metrics")
+	h.Index(&ctx)
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("expected 200 got %d", ctx.Response.StatusCode())
+	}
+
+	if !strings.Contains(string(ctx.Response.Body()), "# TYPE ipapi_proxy_http_requests_total counter\n") {
+		t.Errorf("expected http request metrics in:\n%s", ctx.Response.Body())
+	}
+}
@@ -0,0 +1,350 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds all metrics and writes them in the Prometheus text format.
+// See: https://prometheus.io/docs/instrumenting/exposition_formats/
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry all metrics of the proxy are registered in.
+var Default = &Registry{}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// Write writes all metrics in the registry to w.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// vec contains the shared logic for metrics with labels.
+type vec struct {
+	mu       sync.Mutex
+	name     string
+	help     string
+	typ      string
+	labels   []string
+	children map[string]interface{}
+	new      func() interface{}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.children[key]
+	if !ok {
+		c = v.new()
+		v.children[key] = c
+	}
+	return c
+}
+
+// each calls fn for every child sorted by label values so the output is stable.
+func (v *vec) each(fn func(labels string, child interface{})) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	children := make(map[string]interface{}, len(v.children))
+	for key, c := range v.children {
+		children[key] = c
+	}
+	v.mu.Unlock()
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		fn(formatLabels(v.labels, values), children[key])
+	}
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+func newVec(typ, name, help string, labels []string, new func() interface{}) *vec {
+	return &vec{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: make(map[string]interface{}),
+		new:      new,
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+type CounterVec struct {
+	vec *vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		vec: newVec("counter", name, help, labels, func() interface{} { return &Counter{} }),
+	}
+	r.register(c)
+	return c
+}
+
+// NewCounter returns a counter without any labels.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.vec.with(values).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.vec.header(w)
+	c.vec.each(func(labels string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", c.vec.name, labels, child.(*Counter).Value())
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+type GaugeVec struct {
+	vec *vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		vec: newVec("gauge", name, help, labels, func() interface{} { return &Gauge{} }),
+	}
+	r.register(g)
+	return g
+}
+
+// NewGauge returns a gauge without any labels.
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.vec.with(values).(*Gauge)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.vec.header(w)
+	g.vec.each(func(labels string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", g.vec.name, labels, child.(*Gauge).Value())
+	})
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	sum     uint64 // float64 bits, first in the struct for 64-bit alignment.
+	buckets []float64
+	counts  []uint64 // counts[len(buckets)] is the +Inf bucket.
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, n) {
+			return
+		}
+	}
+}
+
+// Count returns the total number of observations.
+func (h *Histogram) Count() uint64 {
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+	}
+	return count
+}
+
+type HistogramVec struct {
+	vec     *vec
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds, which must be sorted ascending.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		buckets: buckets,
+	}
+	h.vec = newVec("histogram", name, help, labels, func() interface{} {
+		return &Histogram{
+			buckets: h.buckets,
+			counts:  make([]uint64, len(h.buckets)+1),
+		}
+	})
+	r.register(h)
+	return h
+}
+
+// NewHistogram returns a histogram without any labels.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).With()
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.vec.with(values).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.vec.header(w)
+	h.vec.each(func(labels string, child interface{}) {
+		hist := child.(*Histogram)
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += atomic.LoadUint64(&hist.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.vec.name, withLabel(labels, "le", formatFloat(le)), cumulative)
+		}
+		cumulative += atomic.LoadUint64(&hist.counts[len(h.buckets)])
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.vec.name, withLabel(labels, "le", "+Inf"), cumulative)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.vec.name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&hist.sum))))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.vec.name, labels, cumulative)
+	})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// withLabel adds one more label to an already formatted label set.
+func withLabel(labels, name, value string) string {
+	l := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
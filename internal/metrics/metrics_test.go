@@ -0,0 +1,65 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ip-api/proxy/internal/metrics"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := &metrics.Registry{}
+
+	requests := r.NewCounterVec("requests_total", "Total requests.", "route")
+	requests.With("json").Inc()
+	requests.With("batch").Add(2)
+
+	queue := r.NewGaugeVec("queue", "Queue \"depth\".")
+	queue.With().Set(5)
+	queue.With().Dec()
+
+	sizes := r.NewHistogramVec("sizes", "Batch sizes.", []float64{1, 10}, "reason")
+	sizes.With("timer").Observe(1)
+	sizes.With("timer").Observe(5)
+	sizes.With("timer").Observe(50)
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{route="batch"} 2
+requests_total{route="json"} 1
+# HELP queue Queue "depth".
+# TYPE queue gauge
+queue 4
+# HELP sizes Batch sizes.
+# TYPE sizes histogram
+sizes_bucket{reason="timer",le="1"} 1
+sizes_bucket{reason="timer",le="10"} 2
+sizes_bucket{reason="timer",le="+Inf"} 3
+sizes_sum{reason="timer"} 56
+sizes_count{reason="timer"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("\nexpected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := &metrics.Registry{}
+
+	r.NewCounterVec("c", "c", "pop").With("a\"b\\c\nd").Inc()
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# HELP c c\n# TYPE c counter\nc{pop=\"a\\\"b\\\\c\\nd\"} 1\n"
+	if buf.String() != expected {
+		t.Errorf("\nexpected\n%q\ngot\n%q", expected, buf.String())
+	}
+}
@@ -0,0 +1,216 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+)
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Nested maps and arrays deeper than this are considered invalid.
+const maxDepth = 32
+
+// decoder decodes values in the mmdb data section format.
+// Maps are decoded as map[string]interface{}, arrays as []interface{}, unsigned integers as uint64,
+// int32 as int, uint128 as *big.Int, doubles and floats as float64.
+// See: https://maxmind.github.io/MaxMind-DB/#output-data-section
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at offset and the offset directly after it.
+func (d decoder) decode(offset int) (interface{}, int, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d decoder) decodeDepth(offset int, depth int) (interface{}, int, error) {
+	if depth > maxDepth {
+		return nil, 0, ErrInvalidDatabase
+	}
+
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		// The value is stored elsewhere, but the next value is after the pointer.
+		pointer, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeDepth(pointer, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var k, v interface{}
+			if k, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, ErrInvalidDatabase
+			}
+			if v, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d.buf) {
+		return nil, 0, ErrInvalidDatabase
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, offset, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int(int32(u)), offset, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+
+	return nil, 0, ErrInvalidDatabase
+}
+
+// control parses the control byte(s) at offset and returns the type and size of the value.
+func (d decoder) control(offset int) (int, int, int, error) {
+	if offset >= len(d.buf) {
+		return 0, 0, 0, ErrInvalidDatabase
+	}
+	c := d.buf[offset]
+	offset++
+
+	typ := int(c >> 5)
+	if typ == typePointer {
+		// Pointers use the size bits differently.
+		return typ, int(c & 0x1f), offset, nil
+	}
+
+	if typ == typeExtended {
+		if offset >= len(d.buf) {
+			return 0, 0, 0, ErrInvalidDatabase
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+		if typ < typeInt32 || typ > typeFloat {
+			return 0, 0, 0, ErrInvalidDatabase
+		}
+	}
+
+	size := int(c & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(d.buf) {
+			return 0, 0, 0, ErrInvalidDatabase
+		}
+		var v int
+		for _, b := range d.buf[offset : offset+n] {
+			v = v<<8 | int(b)
+		}
+		offset += n
+
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	return typ, size, offset, nil
+}
+
+// pointer returns the offset a pointer points to and the offset after the pointer.
+func (d decoder) pointer(size int, offset int) (int, int, error) {
+	n := (size>>3)&0x3 + 1
+	if offset+n > len(d.buf) {
+		return 0, 0, ErrInvalidDatabase
+	}
+
+	var p int
+	if n < 4 {
+		p = size & 0x7
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		p = p<<8 | int(b)
+	}
+
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+
+	return p, offset + n, nil
+}
@@ -0,0 +1,187 @@
+// Package mmdb reads MaxMind DB files such as GeoLite2-City.mmdb.
+// See: https://maxmind.github.io/MaxMind-DB/
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+var (
+	ErrInvalidDatabase = errors.New("invalid mmdb database")
+
+	metadataStart = []byte("\xab\xcd\xefMaxMind.com")
+)
+
+// The metadata is stored in the last 128KiB of the file.
+const maxMetadataSize = 128 * 1024
+
+// Metadata describes a database.
+type Metadata struct {
+	DatabaseType string   `json:"database_type"`
+	IPVersion    int      `json:"ip_version"`
+	Languages    []string `json:"languages"`
+	BuildEpoch   uint64   `json:"build_epoch"`
+	NodeCount    int      `json:"node_count"`
+	RecordSize   int      `json:"record_size"`
+}
+
+// Reader looks up IPs in a database which is completely read into memory.
+type Reader struct {
+	Metadata Metadata
+
+	tree []byte
+	data []byte
+
+	nodeSize  int
+	ipv4Start int // Node at ::/96, where IPv4 addresses start in IPv6 databases.
+}
+
+// Open reads the database at path.
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(buf)
+}
+
+// New returns a Reader for a database in buf.
+func New(buf []byte) (*Reader, error) {
+	search := buf
+	if len(search) > maxMetadataSize {
+		search = search[len(search)-maxMetadataSize:]
+	}
+	i := bytes.LastIndex(search, metadataStart)
+	if i < 0 {
+		return nil, ErrInvalidDatabase
+	}
+	metaStart := len(buf) - len(search) + i + len(metadataStart)
+
+	meta, _, err := decoder{buf[metaStart:]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidDatabase
+	}
+
+	r := &Reader{}
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+	r.Metadata.IPVersion = int(toUint(m["ip_version"]))
+	r.Metadata.BuildEpoch = toUint(m["build_epoch"])
+	r.Metadata.NodeCount = int(toUint(m["node_count"]))
+	r.Metadata.RecordSize = int(toUint(m["record_size"]))
+	if languages, ok := m["languages"].([]interface{}); ok {
+		for _, l := range languages {
+			if s, ok := l.(string); ok {
+				r.Metadata.Languages = append(r.Metadata.Languages, s)
+			}
+		}
+	}
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", r.Metadata.IPVersion)
+	}
+
+	r.nodeSize = r.Metadata.RecordSize / 4
+	treeSize := r.Metadata.NodeCount * r.nodeSize
+
+	// The search tree is followed by 16 zero bytes and then the data section.
+	dataStart := treeSize + 16
+	dataEnd := metaStart - len(metadataStart)
+	if dataStart > dataEnd {
+		return nil, ErrInvalidDatabase
+	}
+
+	r.tree = buf[:treeSize]
+	r.data = buf[dataStart:dataEnd]
+
+	if r.Metadata.IPVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.Metadata.NodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) record(node int, bit uint) int {
+	b := r.tree[node*r.nodeSize : (node+1)*r.nodeSize]
+
+	switch r.Metadata.RecordSize {
+	case 24:
+		if bit == 0 {
+			return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3])<<16 | int(b[4])<<8 | int(b[5])
+	case 28:
+		if bit == 0 {
+			return int(b[3]&0xf0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0f)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	default:
+		if bit == 0 {
+			return int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		}
+		return int(b[4])<<24 | int(b[5])<<16 | int(b[6])<<8 | int(b[7])
+	}
+}
+
+// Lookup returns the record for ip, which is usually a map[string]interface{}.
+// Lookup returns false if the database doesn't contain ip.
+func (r *Reader) Lookup(ip net.IP) (interface{}, bool, error) {
+	node := 0
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 4 {
+		// IPv6 addresses can't be looked up in IPv4 databases.
+		return nil, false, nil
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == nodeCount {
+		return nil, false, nil
+	} else if node < nodeCount {
+		return nil, false, ErrInvalidDatabase
+	}
+
+	offset := node - nodeCount - 16
+	if offset < 0 || offset >= len(r.data) {
+		return nil, false, ErrInvalidDatabase
+	}
+
+	v, _, err := decoder{r.data}.decode(offset)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return v, true, nil
+}
+
+func toUint(v interface{}) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case int:
+		return uint64(v)
+	}
+	return 0
+}
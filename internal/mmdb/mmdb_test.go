@@ -0,0 +1,183 @@
+package mmdb_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ip-api/proxy/internal/mmdb"
+)
+
+var update = flag.Bool("update", false, "rewrite the databases in testdata")
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestLookup(t *testing.T) {
+	w := mmdb.Writer{
+		DatabaseType: "Test-City",
+		Languages:    []string{"en", "de"},
+	}
+
+	records := []struct {
+		network string
+		record  interface{}
+	}{
+		{"1.0.0.0/8", map[string]interface{}{
+			"city": map[string]interface{}{
+				"names": map[string]interface{}{"en": "Some City", "de": "Eine Stadt"},
+			},
+			"location": map[string]interface{}{
+				"latitude":  -33.494,
+				"longitude": 143.2104,
+			},
+			"autonomous_system_number": uint32(13335),
+		}},
+		{"1.1.1.0/24", map[string]interface{}{
+			"subdivisions": []interface{}{
+				map[string]interface{}{"iso_code": "NSW"},
+			},
+			"is_anycast": true,
+			"offset":     -3600,
+			"long":       "a string that is longer than 29 bytes to test the size encoding",
+		}},
+		{"2001:db8::/32", map[string]interface{}{"country": "Some IPv6 Country"}},
+	}
+
+	for _, r := range records {
+		if err := w.Insert(mustCIDR(r.network), r.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := w.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := mmdb.New(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reader.Metadata.DatabaseType != "Test-City" || reader.Metadata.IPVersion != 6 || reader.Metadata.RecordSize != 28 {
+		t.Errorf("unexpected metadata %+v", reader.Metadata)
+	}
+	if !reflect.DeepEqual(reader.Metadata.Languages, []string{"en", "de"}) {
+		t.Errorf("expected [en de] got %v", reader.Metadata.Languages)
+	}
+
+	tests := []struct {
+		ip       string
+		expected interface{}
+	}{
+		{"1.2.3.4", records[0].record},
+		{"1.1.0.255", records[0].record},
+		{"1.1.1.1", records[1].record},
+		{"1.1.2.1", records[0].record},
+		{"::ffff:1.1.1.1", records[1].record},
+		{"2.2.2.2", nil},
+		{"2001:db8:1::1", records[2].record},
+		{"2001:db9::1", nil},
+	}
+
+	for _, test := range tests {
+		v, ok, err := reader.Lookup(net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("%s: %v", test.ip, err)
+			continue
+		}
+
+		if test.expected == nil {
+			if ok {
+				t.Errorf("%s: expected no record got %v", test.ip, v)
+			}
+			continue
+		}
+
+		// The decoder returns all unsigned integers as uint64.
+		expected := normalize(test.expected)
+		if !ok || !reflect.DeepEqual(v, expected) {
+			t.Errorf("%s: expected %v got %v", test.ip, expected, v)
+		}
+	}
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case uint32:
+		return uint64(v)
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = normalize(e)
+		}
+		return a
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalize(e)
+		}
+		return m
+	}
+	return v
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := mmdb.New([]byte("not a database")); err != mmdb.ErrInvalidDatabase {
+		t.Errorf("expected ErrInvalidDatabase got %v", err)
+	}
+}
+
+// TestTestdata checks the databases in testdata used by tests in other packages.
+// Run go test -update after changing them.
+func TestTestdata(t *testing.T) {
+	w := mmdb.Writer{DatabaseType: "Test-City"}
+	if err := w.Insert(mustCIDR("1.2.3.0/24"), map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "SC",
+			"names":    map[string]interface{}{"en": "Some Country"},
+		},
+		"city": map[string]interface{}{
+			"names": map[string]interface{}{"en": "Some City"},
+		},
+		"location": map[string]interface{}{
+			"latitude":  13.0,
+			"longitude": 37.0,
+			"time_zone": "UTC",
+		},
+		"autonomous_system_number":       uint32(64496),
+		"autonomous_system_organization": "Some ISP",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := w.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join("testdata", "test-city.mmdb")
+	if *update {
+		if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(current, buf) {
+		t.Errorf("%s is outdated, run go test -update", path)
+	}
+}
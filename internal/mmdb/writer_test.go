@@ -0,0 +1,230 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+)
+
+// Writer creates IPv6 databases with 28 bit records.
+// It is meant for small databases used in tests, it doesn't deduplicate data.
+// The databases used by tests in other packages are written to testdata by TestTestdata.
+type Writer struct {
+	DatabaseType string
+	Languages    []string
+
+	root *writerNode
+	data []byte
+}
+
+type writerNode struct {
+	children [2]*writerNode
+
+	// Offset in the data section + 1 for leaves.
+	data int
+}
+
+// Insert adds a network with its record. Records of more specific networks
+// have to be inserted after less specific ones.
+func (w *Writer) Insert(network *net.IPNet, record interface{}) error {
+	if w.root == nil {
+		w.root = &writerNode{}
+	}
+
+	ip := network.IP.To16()
+	ones, bits := network.Mask.Size()
+	if ip4 := network.IP.To4(); ip4 != nil {
+		// IPv4 networks are stored at ::/96.
+		ip = make(net.IP, net.IPv6len)
+		copy(ip[12:], ip4)
+		ones += 96
+		bits += 96
+	}
+	if ip == nil || bits != 128 {
+		return fmt.Errorf("invalid network %s", network)
+	}
+
+	offset := len(w.data)
+	data, err := encode(w.data, record)
+	if err != nil {
+		return err
+	}
+	w.data = data
+
+	node := w.root
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		child := node.children[bit]
+		if child == nil {
+			child = &writerNode{}
+			node.children[bit] = child
+		} else if child.data > 0 && i < ones-1 {
+			// Split the less specific network.
+			child.children[0] = &writerNode{data: child.data}
+			child.children[1] = &writerNode{data: child.data}
+			child.data = 0
+		}
+		node = child
+	}
+	node.children = [2]*writerNode{}
+	node.data = offset + 1
+
+	return nil
+}
+
+// Bytes returns the database.
+func (w *Writer) Bytes() ([]byte, error) {
+	if w.root == nil {
+		w.root = &writerNode{}
+	}
+
+	// Number all inner nodes.
+	var nodes []*writerNode
+	ids := make(map[*writerNode]int)
+	var number func(n *writerNode)
+	number = func(n *writerNode) {
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && c.data == 0 {
+				number(c)
+			}
+		}
+	}
+	number(w.root)
+
+	nodeCount := len(nodes)
+	record := func(c *writerNode) int {
+		if c == nil {
+			return nodeCount
+		} else if c.data > 0 {
+			return nodeCount + 16 + c.data - 1
+		}
+		return ids[c]
+	}
+
+	buf := make([]byte, 0, nodeCount*7+16+len(w.data)+256)
+	for _, n := range nodes {
+		l, r := record(n.children[0]), record(n.children[1])
+		buf = append(buf,
+			byte(l>>16), byte(l>>8), byte(l),
+			byte(l>>24&0x0f)<<4|byte(r>>24&0x0f),
+			byte(r>>16), byte(r>>8), byte(r),
+		)
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, w.data...)
+	buf = append(buf, metadataStart...)
+
+	languages := make([]interface{}, len(w.Languages))
+	for i, l := range w.Languages {
+		languages[i] = l
+	}
+
+	return encode(buf, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"database_type":               w.DatabaseType,
+		"languages":                   languages,
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(28),
+	})
+}
+
+func encode(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		buf = encodeControl(buf, typeString, len(v))
+		return append(buf, v...), nil
+	case float64:
+		buf = encodeControl(buf, typeDouble, 8)
+		return append(buf, uint64Bytes(math.Float64bits(v), 8)...), nil
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return encodeControl(buf, typeBool, size), nil
+	case uint16:
+		buf = encodeControl(buf, typeUint16, 2)
+		return append(buf, uint64Bytes(uint64(v), 2)...), nil
+	case uint32:
+		buf = encodeControl(buf, typeUint32, 4)
+		return append(buf, uint64Bytes(uint64(v), 4)...), nil
+	case uint64:
+		buf = encodeControl(buf, typeUint64, 8)
+		return append(buf, uint64Bytes(v, 8)...), nil
+	case int:
+		buf = encodeControl(buf, typeInt32, 4)
+		return append(buf, uint64Bytes(uint64(uint32(int32(v))), 4)...), nil
+	case []interface{}:
+		buf = encodeControl(buf, typeArray, len(v))
+		for _, e := range v {
+			var err error
+			if buf, err = encode(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = encodeControl(buf, typeMap, len(v))
+
+		// Sort the keys so the output is deterministic.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			var err error
+			if buf, err = encode(buf, k); err != nil {
+				return nil, err
+			}
+			if buf, err = encode(buf, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	return nil, fmt.Errorf("can't encode %T", v)
+}
+
+func encodeControl(buf []byte, typ int, size int) []byte {
+	var extended byte
+	if typ > 7 {
+		extended = byte(typ - 7)
+		typ = typeExtended
+	}
+
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		sizeBytes = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		sizeBytes = uint64Bytes(uint64(size-285), 2)
+		size = 30
+	default:
+		sizeBytes = uint64Bytes(uint64(size-65821), 3)
+		size = 31
+	}
+
+	buf = append(buf, byte(typ<<5|size))
+	if extended > 0 {
+		buf = append(buf, extended)
+	}
+	return append(buf, sizeBytes...)
+}
+
+func uint64Bytes(v uint64, n int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return b[8-n:]
+}
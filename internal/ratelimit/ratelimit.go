@@ -0,0 +1,257 @@
+// Package ratelimit limits how many entries each client can look up using token buckets.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// Buckets of a client.
+const (
+	BucketHits    = "hits"
+	BucketFetches = "fetches"
+)
+
+// How often clients whose buckets are full again are forgotten.
+const cleanupInterval = time.Minute
+
+var (
+	metricEntries = metrics.NewCounterVec("ipapi_proxy_ratelimit_entries_total", "Number of entries checked against the rate limits, by bucket and result.", "bucket", "result")
+	metricClients = metrics.NewGauge("ipapi_proxy_ratelimit_clients", "Number of clients with rate limit state.")
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limit struct {
+	capacity float64
+	rate     float64 // Tokens per second.
+}
+
+// take refills b and then takes n tokens if it has enough.
+// It returns the tokens left and how long until b is full again, or until b has n tokens when it doesn't.
+func (l limit) take(b *bucket, n int, now time.Time) (bool, float64, time.Duration) {
+	b.tokens = math.Min(l.capacity, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if float64(n) > b.tokens {
+		return false, b.tokens, l.until(float64(n) - b.tokens)
+	}
+
+	b.tokens -= float64(n)
+	return true, b.tokens, l.until(l.capacity - b.tokens)
+}
+
+// until returns how long it takes to refill tokens.
+func (l limit) until(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+type client struct {
+	hits    bucket
+	fetches bucket
+}
+
+// Result is the outcome of Allow for the most limited bucket.
+type Result struct {
+	Allowed bool
+	// Remaining is the number of entries that can still be looked up.
+	Remaining int
+	// Reset is how long until Remaining is back at the limit,
+	// or until the request would be allowed if it wasn't.
+	Reset time.Duration
+	// TooLarge is true if the request needs more entries than a bucket holds.
+	// It is never allowed and Reset is 0.
+	TooLarge bool
+}
+
+// Limiter keeps a token bucket for entries answered from the cache
+// and one for entries which need an upstream fetch for every client.
+// The buckets hold a minute of entries and are refilled continuously.
+type Limiter struct {
+	mu      sync.Mutex
+	hits    *limit
+	fetches *limit
+	clients map[string]*client
+}
+
+// New returns a Limiter for RATE_LIMIT_HITS and RATE_LIMIT_FETCHES, the number of entries
+// per minute. A limit of 0 disables the bucket. If both are 0 New returns nil.
+func New(cfg config.Config) *Limiter {
+	if cfg.RateLimitHits == 0 && cfg.RateLimitFetches == 0 {
+		return nil
+	}
+
+	l := &Limiter{
+		clients: make(map[string]*client),
+	}
+	if cfg.RateLimitHits > 0 {
+		l.hits = &limit{float64(cfg.RateLimitHits), float64(cfg.RateLimitHits) / 60}
+	}
+	if cfg.RateLimitFetches > 0 {
+		l.fetches = &limit{float64(cfg.RateLimitFetches), float64(cfg.RateLimitFetches) / 60}
+	}
+
+	go func() {
+		for {
+			time.Sleep(cleanupInterval)
+			l.cleanup()
+		}
+	}()
+
+	return l
+}
+
+// Allow takes hits and fetches tokens from the buckets of key, which identifies the client.
+// Either all tokens are taken or, if a bucket doesn't have enough, none are.
+// Requests for more tokens than a bucket holds are never allowed, see Result.TooLarge.
+func (l *Limiter) Allow(key string, hits, fetches int) Result {
+	now := util.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{
+			hits:    l.full(l.hits, now),
+			fetches: l.full(l.fetches, now),
+		}
+		l.clients[key] = c
+		metricClients.Set(int64(len(l.clients)))
+	}
+
+	// Work on copies so nothing is taken when a request isn't allowed.
+	hb, fb := c.hits, c.fetches
+
+	result := Result{Allowed: true, Remaining: math.MaxInt32}
+	for _, check := range []struct {
+		limit *limit
+		b     *bucket
+		n     int
+	}{
+		{l.hits, &hb, hits},
+		{l.fetches, &fb, fetches},
+	} {
+		if check.limit == nil {
+			continue
+		}
+
+		if float64(check.n) > check.limit.capacity {
+			result.TooLarge = true
+		}
+
+		allowed, tokens, reset := check.limit.take(check.b, check.n, now)
+		if !allowed {
+			if result.Allowed || reset > result.Reset {
+				result.Reset = reset
+			}
+			result.Allowed = false
+			result.Remaining = int(tokens)
+		} else if result.Allowed && int(tokens) < result.Remaining {
+			result.Remaining = int(tokens)
+			result.Reset = reset
+		}
+	}
+
+	if result.TooLarge {
+		// Waiting doesn't help.
+		result.Reset = 0
+	}
+
+	outcome := "limited"
+	if result.TooLarge {
+		outcome = "too_large"
+	} else if result.Allowed {
+		outcome = "allowed"
+		c.hits, c.fetches = hb, fb
+	}
+	if l.hits != nil {
+		metricEntries.With(BucketHits, outcome).Add(int64(hits))
+	}
+	if l.fetches != nil {
+		metricEntries.With(BucketFetches, outcome).Add(int64(fetches))
+	}
+
+	return result
+}
+
+func (l *Limiter) full(lim *limit, now time.Time) bucket {
+	if lim == nil {
+		return bucket{}
+	}
+	return bucket{tokens: lim.capacity, last: now}
+}
+
+// cleanup forgets clients whose buckets are full again, they don't have to be tracked.
+func (l *Limiter) cleanup() {
+	now := util.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, c := range l.clients {
+		full := true
+		for _, check := range []struct {
+			limit *limit
+			b     *bucket
+		}{
+			{l.hits, &c.hits},
+			{l.fetches, &c.fetches},
+		} {
+			if check.limit != nil {
+				if _, tokens, _ := check.limit.take(check.b, 0, now); tokens < check.limit.capacity {
+					full = false
+				}
+			}
+		}
+
+		if full {
+			delete(l.clients, key)
+		}
+	}
+
+	metricClients.Set(int64(len(l.clients)))
+}
+
+// Debug returns the remaining tokens of every client.
+func (l *Limiter) Debug() interface{} {
+	now := util.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clients := make(map[string]map[string]int, len(l.clients))
+	for key, c := range l.clients {
+		remaining := make(map[string]int, 2)
+		if l.hits != nil {
+			_, tokens, _ := l.hits.take(&c.hits, 0, now)
+			remaining[BucketHits] = int(tokens)
+		}
+		if l.fetches != nil {
+			_, tokens, _ := l.fetches.take(&c.fetches, 0, now)
+			remaining[BucketFetches] = int(tokens)
+		}
+		clients[key] = remaining
+	}
+
+	limits := make(map[string]float64, 2)
+	if l.hits != nil {
+		limits[BucketHits] = l.hits.capacity
+	}
+	if l.fetches != nil {
+		limits[BucketFetches] = l.fetches.capacity
+	}
+
+	return map[string]interface{}{
+		"limits":  limits,
+		"clients": clients,
+	}
+}
@@ -0,0 +1,64 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/ratelimit"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+func TestDisabled(t *testing.T) {
+	if l := ratelimit.New(config.Default()); l != nil {
+		t.Errorf("expected no limiter got %v", l)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	currentTime := time.Now()
+	util.Now = func() time.Time {
+		return currentTime
+	}
+	defer func() {
+		util.Now = time.Now
+	}()
+
+	cfg := config.Default()
+	cfg.RateLimitHits = 60
+	cfg.RateLimitFetches = 6
+	l := ratelimit.New(cfg)
+
+	tests := []struct {
+		wait     time.Duration
+		hits     int
+		fetches  int
+		expected ratelimit.Result
+	}{
+		{0, 10, 2, ratelimit.Result{Allowed: true, Remaining: 4, Reset: time.Second * 20}},
+		{0, 0, 5, ratelimit.Result{Allowed: false, Remaining: 4, Reset: time.Second * 10}},
+		// Nothing was taken by the failed request.
+		{0, 50, 4, ratelimit.Result{Allowed: true, Remaining: 0, Reset: time.Minute}},
+		{0, 1, 0, ratelimit.Result{Allowed: false, Remaining: 0, Reset: time.Second}},
+		{time.Second * 10, 10, 1, ratelimit.Result{Allowed: true, Remaining: 0, Reset: time.Minute}},
+		{time.Hour, 0, 0, ratelimit.Result{Allowed: true, Remaining: 6, Reset: 0}},
+		// More than the bucket holds is never allowed, so there is no time to retry after.
+		{0, 61, 0, ratelimit.Result{Allowed: false, Remaining: 60, TooLarge: true}},
+		{time.Hour, 10, 7, ratelimit.Result{Allowed: false, Remaining: 6, TooLarge: true}},
+		// Nothing was taken by the request that was too large.
+		{0, 60, 6, ratelimit.Result{Allowed: true, Remaining: 0, Reset: time.Minute}},
+	}
+
+	for i, test := range tests {
+		currentTime = currentTime.Add(test.wait)
+
+		if r := l.Allow("1.1.1.1", test.hits, test.fetches); r != test.expected {
+			t.Errorf("%d: expected %+v got %+v", i, test.expected, r)
+		}
+	}
+
+	// Other clients have their own buckets.
+	if r := l.Allow("1.0.0.1", 0, 6); !r.Allowed {
+		t.Errorf("expected 1.0.0.1 to be allowed got %+v", r)
+	}
+}
@@ -0,0 +1,206 @@
+package resolve
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal DNS client, net.Resolver doesn't expose record TTLs.
+// See: https://tools.ietf.org/html/rfc1035#section-4
+
+const (
+	typeA     = 1
+	typeAAAA  = 28
+	classIN   = 1
+	rcodeNX   = 3
+	headerLen = 12
+)
+
+var errInvalidMessage = errors.New("invalid dns message")
+
+// exchange sends a query for host to server and returns all records of qtype with the lowest TTL.
+// It retries over TCP if the UDP response was truncated.
+func exchange(server, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query := buildQuery(id, host, qtype)
+
+	response, err := exchangeUDP(server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(response) >= headerLen && response[2]&0x02 != 0 {
+		// Truncated, retry over TCP.
+		if response, err = exchangeTCP(server, query); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return parseResponse(response, id, qtype)
+}
+
+func exchangeUDP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func exchangeTCP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func buildQuery(id uint16, host string, qtype uint16) []byte {
+	msg := make([]byte, headerLen, headerLen+len(host)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	msg[2] = 0x01 // Recursion desired.
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(host, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, classIN)
+	return msg
+}
+
+func parseResponse(msg []byte, id uint16, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(msg) < headerLen {
+		return nil, 0, errInvalidMessage
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id || msg[2]&0x80 == 0 {
+		return nil, 0, errors.New("unexpected dns message")
+	}
+
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case rcodeNX:
+		return nil, 0, ErrNotFound
+	default:
+		return nil, 0, errors.New("dns server returned rcode " + strconv.Itoa(int(rcode)))
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := headerLen
+	var err error
+
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4 // Type and class.
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+
+	// The answers contain the whole CNAME chain, so we just take all records of the requested type.
+	for i := 0; i < ancount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errInvalidMessage
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rclass := binary.BigEndian.Uint16(msg[off+2:])
+		rttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+
+		if off+rdlength > len(msg) {
+			return nil, 0, errInvalidMessage
+		}
+		rdata := msg[off : off+rdlength]
+		off += rdlength
+
+		if rclass != classIN || rtype != qtype {
+			continue
+		}
+		if (rtype == typeA && rdlength != net.IPv4len) || (rtype == typeAAAA && rdlength != net.IPv6len) {
+			return nil, 0, errInvalidMessage
+		}
+
+		ips = append(ips, net.IP(append([]byte(nil), rdata...)))
+		if len(ips) == 1 || rttl < ttl {
+			ttl = rttl
+		}
+	}
+
+	return ips, ttl, nil
+}
+
+// skipName returns the offset directly after the (possibly compressed) name at off.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errInvalidMessage
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// Compression pointer, the name ends here.
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package resolve
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// ErrNotFound is returned when a hostname doesn't have any A or AAAA records.
+var ErrNotFound = errors.New("no such host")
+
+const (
+	// For how long to cache hostnames without any records.
+	negativeTTL = time.Minute
+	// For how long to cache results of the system resolver, which doesn't expose TTLs.
+	fallbackTTL = time.Minute
+	// Upper bound on record TTLs.
+	maxTTL = time.Hour * 24
+
+	maxEntries = 100000
+	timeout    = time.Second * 2
+)
+
+var (
+	metricLookups = metrics.NewCounterVec("ipapi_proxy_resolve_lookups_total", "Number of hostname lookups by result.", "result")
+)
+
+type Resolver interface {
+	// Resolve returns the IP ip-api.com would use for host.
+	Resolve(host string) (net.IP, error)
+}
+
+type entry struct {
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+type resolver struct {
+	logger zerolog.Logger
+
+	servers []string
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// New returns a Resolver that caches results for as long as their DNS TTL.
+// It queries the servers in RESOLVE_SERVERS, or the nameservers in /etc/resolv.conf.
+func New(logger zerolog.Logger, cfg config.Config) Resolver {
+	var servers []string
+	if len(cfg.ResolveServers) > 0 {
+		for _, s := range cfg.ResolveServers {
+			servers = append(servers, withPort(s))
+		}
+	} else {
+		servers = resolvConf("/etc/resolv.conf")
+	}
+
+	return &resolver{
+		logger:  logger,
+		servers: servers,
+		entries: make(map[string]entry),
+	}
+}
+
+// resolvConf returns the nameservers in a resolv.conf file.
+func resolvConf(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, withPort(fields[1]))
+		}
+	}
+	return servers
+}
+
+func withPort(s string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	return net.JoinHostPort(s, "53")
+}
+
+// ValidHostname reports if s is syntactically a valid hostname.
+func ValidHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 || !strings.Contains(s, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (r *resolver) Resolve(host string) (net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	r.mu.Unlock()
+
+	if ok && e.expires.After(util.Now()) {
+		metricLookups.With("cached").Inc()
+		return e.ip, e.err
+	}
+
+	ip, ttl, err := r.lookup(host)
+	if err != nil && err != ErrNotFound {
+		r.logger.Debug().Err(err).Str("host", host).Msg("dns lookup failed, using system resolver")
+
+		ip, err = r.lookupSystem(host)
+		ttl = fallbackTTL
+	}
+
+	if err == ErrNotFound {
+		ttl = negativeTTL
+		metricLookups.With("notfound").Inc()
+	} else if err != nil {
+		// Don't cache other errors.
+		metricLookups.With("error").Inc()
+		return nil, err
+	} else {
+		metricLookups.With("success").Inc()
+	}
+
+	r.mu.Lock()
+	if len(r.entries) >= maxEntries {
+		r.evictLocked()
+	}
+	r.entries[host] = entry{
+		ip:      ip,
+		err:     err,
+		expires: util.Now().Add(ttl),
+	}
+	r.mu.Unlock()
+
+	return ip, err
+}
+
+// evictLocked removes expired entries, or random entries if none are expired.
+// evictLocked assumes r.mu is already locked.
+func (r *resolver) evictLocked() {
+	now := util.Now()
+	for host, e := range r.entries {
+		if e.expires.Before(now) {
+			delete(r.entries, host)
+		}
+	}
+
+	// Map iteration order is random.
+	for host := range r.entries {
+		if len(r.entries) < maxEntries {
+			break
+		}
+		delete(r.entries, host)
+	}
+}
+
+// lookup queries the configured servers for A records, and AAAA records if there are no A records.
+// IPv4 is preferred as that is what ip-api.com does.
+func (r *resolver) lookup(host string) (net.IP, time.Duration, error) {
+	if len(r.servers) == 0 {
+		return nil, 0, errors.New("no dns servers configured")
+	}
+
+	var err error
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		var ips []net.IP
+		var ttl time.Duration
+
+		// Try each server until one answers.
+		for _, server := range r.servers {
+			if ips, ttl, err = exchange(server, host, qtype); err == nil || err == ErrNotFound {
+				break
+			}
+		}
+
+		if err == ErrNotFound {
+			// NXDOMAIN, there won't be any AAAA records either.
+			return nil, 0, err
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		if len(ips) > 0 {
+			if ttl > maxTTL {
+				ttl = maxTTL
+			}
+			return ips[rand.Intn(len(ips))], ttl, nil
+		}
+	}
+
+	return nil, 0, ErrNotFound
+}
+
+func (r *resolver) lookupSystem(host string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			return a.IP, nil
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0].IP, nil
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,119 @@
+package resolve_test
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/resolve"
+	"github.com/ip-api/proxy/internal/util"
+)
+
+// dnsServer answers A queries for a.example.com with 1.1.1.1 (after a CNAME) and
+// AAAA queries for b.example.com with 2606:4700::1111. Everything else is NXDOMAIN.
+func dnsServer(t *testing.T, queries *int64) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(queries, 1)
+
+			query := buf[:n]
+			qtype := binary.BigEndian.Uint16(query[n-4:])
+			name := string(query[12 : n-4])
+
+			res := append([]byte{}, query...)
+			res[2] |= 0x80 // Response.
+
+			var answers [][]byte
+			switch {
+			case name == "\x01a\x07example\x03com\x00" && qtype == 1:
+				answers = [][]byte{
+					// CNAME to the question name using a compression pointer.
+					{0xc0, 12, 0, 5, 0, 1, 0, 0, 0x0e, 0x10, 0, 2, 0xc0, 12},
+					{0xc0, 12, 0, 1, 0, 1, 0, 0, 0x01, 0x2c, 0, 4, 1, 1, 1, 1},
+				}
+			case name == "\x01b\x07example\x03com\x00" && qtype == 28:
+				answers = [][]byte{
+					{0xc0, 12, 0, 28, 0, 1, 0, 0, 0, 60, 0, 16, 0x26, 0x06, 0x47, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x11, 0x11},
+				}
+			case name == "\x01b\x07example\x03com\x00":
+				// No A records.
+			default:
+				res[3] |= 3 // NXDOMAIN
+			}
+
+			binary.BigEndian.PutUint16(res[6:], uint16(len(answers)))
+			for _, a := range answers {
+				res = append(res, a...)
+			}
+
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn.LocalAddr().String()
+}
+
+func TestResolve(t *testing.T) {
+	var queries int64
+	cfg := config.Default()
+	cfg.ResolveServers = []string{dnsServer(t, &queries)}
+
+	r := resolve.New(zerolog.New(zerolog.ConsoleWriter{Out: util.ZerologTestWriter{T: t}, NoColor: true}), cfg)
+
+	for host, expected := range map[string]string{
+		"a.example.com":  "1.1.1.1",
+		"A.example.com.": "1.1.1.1",
+		"b.example.com":  "2606:4700::1111",
+	} {
+		ip, err := r.Resolve(host)
+		if err != nil {
+			t.Errorf("%s: %v", host, err)
+		} else if ip.String() != expected {
+			t.Errorf("%s: expected %s got %s", host, expected, ip)
+		}
+	}
+
+	if _, err := r.Resolve("c.example.com"); err != resolve.ErrNotFound {
+		t.Errorf("expected %v got %v", resolve.ErrNotFound, err)
+	}
+
+	// a.example.com is cached after the first lookup, b.example.com needs an A and AAAA query.
+	if q := atomic.LoadInt64(&queries); q != 4 {
+		t.Errorf("expected 4 queries got %d", q)
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	for host, expected := range map[string]bool{
+		"example.com":        true,
+		"sub-1.example.com.": true,
+		"localhost":          false,
+		"-a.example.com":     false,
+		"a..example.com":     false,
+		"exa mple.com":       false,
+		"1.1.1.1:80":         false,
+		"":                   false,
+	} {
+		if valid := resolve.ValidHostname(host); valid != expected {
+			t.Errorf("%q: expected %v got %v", host, expected, valid)
+		}
+	}
+}
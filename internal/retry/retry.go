@@ -0,0 +1,125 @@
+// Package retry decides if and when failed upstream requests are retried.
+package retry
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Class of the outcome of an upstream request.
+type Class string
+
+const (
+	// OK is a 2xx status.
+	OK Class = "ok"
+	// Network means no response was received.
+	Network Class = "network"
+	// Invalid means the response couldn't be parsed.
+	Invalid Class = "invalid"
+	// Client means the request itself is wrong, a 4xx status other than 429.
+	Client Class = "client"
+	// RateLimited is a 429 status.
+	RateLimited Class = "rate_limited"
+	// Unavailable is a 503 status.
+	Unavailable Class = "unavailable"
+	// Server is any other unexpected status.
+	Server Class = "server"
+)
+
+// The longest backoff between attempts, before jitter.
+const maxBackoff = time.Second * 5
+
+// Classify returns the class of a response with status.
+func Classify(status int) Class {
+	switch {
+	case status >= 200 && status < 300:
+		return OK
+	case status == fasthttp.StatusTooManyRequests:
+		return RateLimited
+	case status == fasthttp.StatusServiceUnavailable:
+		return Unavailable
+	case status >= 400 && status < 500:
+		return Client
+	default:
+		return Server
+	}
+}
+
+// Retryable returns true if another attempt could succeed.
+func (c Class) Retryable() bool {
+	return c != OK && c != Client
+}
+
+// Wait returns how long to wait before the next attempt, attempt starts at 0.
+// For RateLimited and Unavailable responses the time from the Retry-After header,
+// or ip-api's X-Ttl header, is used if there is one. Otherwise it's an exponential
+// backoff from base with jitter.
+func Wait(c Class, res *fasthttp.Response, attempt int, base time.Duration) time.Duration {
+	if res != nil && (c == RateLimited || c == Unavailable) {
+		if d, ok := upstreamWait(res); ok {
+			return d
+		}
+	}
+
+	return Backoff(attempt, base)
+}
+
+// Exhausted returns the time until ip-api's rate limit window resets if res says no
+// requests are left in it, which is X-Rl being 0. Any response can say so, not only a 429.
+func Exhausted(res *fasthttp.Response) (time.Duration, bool) {
+	if string(res.Header.Peek("X-Rl")) != "0" {
+		return 0, false
+	}
+
+	if s, err := strconv.Atoi(string(res.Header.Peek("X-Ttl"))); err == nil && s > 0 {
+		return time.Duration(s) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// upstreamWait returns the time the upstream asked us to wait.
+func upstreamWait(res *fasthttp.Response) (time.Duration, bool) {
+	if v := res.Header.Peek("Retry-After"); len(v) > 0 {
+		// Either a number of seconds or a date.
+		if s, err := strconv.Atoi(string(v)); err == nil && s >= 0 {
+			return time.Duration(s) * time.Second, true
+		}
+		if t, err := fasthttp.ParseHTTPDate(v); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d, true
+			}
+			return 0, true
+		}
+	}
+
+	// Seconds until the rate limit window resets.
+	if v := res.Header.Peek("X-Ttl"); len(v) > 0 {
+		if s, err := strconv.Atoi(string(v)); err == nil && s >= 0 {
+			return time.Duration(s) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+// Backoff returns base doubled for every attempt, up to 5 seconds,
+// of which a random half is taken off so retries are spread out.
+func Backoff(attempt int, base time.Duration) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
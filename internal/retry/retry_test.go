@@ -0,0 +1,104 @@
+package retry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"github.com/ip-api/proxy/internal/retry"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		status    int
+		expected  retry.Class
+		retryable bool
+	}{
+		{200, retry.OK, false},
+		{403, retry.Client, false},
+		{404, retry.Client, false},
+		{429, retry.RateLimited, true},
+		{500, retry.Server, true},
+		{502, retry.Server, true},
+		{503, retry.Unavailable, true},
+	}
+
+	for _, test := range tests {
+		c := retry.Classify(test.status)
+		if c != test.expected {
+			t.Errorf("%d: expected %s got %s", test.status, test.expected, c)
+		}
+		if c.Retryable() != test.retryable {
+			t.Errorf("%d: expected retryable %v", test.status, test.retryable)
+		}
+	}
+
+	if !retry.Network.Retryable() || !retry.Invalid.Retryable() {
+		t.Error("expected network errors and invalid responses to be retryable")
+	}
+}
+
+func TestWait(t *testing.T) {
+	response := func(headers ...string) *fasthttp.Response {
+		var res fasthttp.Response
+		for i := 0; i < len(headers); i += 2 {
+			res.Header.Set(headers[i], headers[i+1])
+		}
+		return &res
+	}
+
+	tests := []struct {
+		class    retry.Class
+		res      *fasthttp.Response
+		attempt  int
+		min, max time.Duration
+	}{
+		{retry.RateLimited, response("Retry-After", "3"), 0, time.Second * 3, time.Second * 3},
+		{retry.RateLimited, response("X-Rl", "0", "X-Ttl", "7"), 0, time.Second * 7, time.Second * 7},
+		{retry.Unavailable, response("Retry-After", "2", "X-Ttl", "7"), 0, time.Second * 2, time.Second * 2},
+		{retry.Unavailable, response("Retry-After", string(fasthttp.AppendHTTPDate(nil, time.Now().Add(-time.Minute)))), 0, 0, 0},
+		// Only 429 and 503 responses say how long to wait.
+		{retry.Server, response("Retry-After", "3"), 0, time.Millisecond * 50, time.Millisecond * 100},
+		{retry.RateLimited, response(), 1, time.Millisecond * 100, time.Millisecond * 200},
+		{retry.Network, nil, 2, time.Millisecond * 200, time.Millisecond * 400},
+		{retry.Network, nil, 100, time.Millisecond * 2500, time.Second * 5},
+	}
+
+	for i, test := range tests {
+		for j := 0; j < 10; j++ {
+			if d := retry.Wait(test.class, test.res, test.attempt, time.Millisecond*100); d < test.min || d > test.max {
+				t.Errorf("%d: expected between %s and %s got %s", i, test.min, test.max, d)
+			}
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	tests := []struct {
+		rl, ttl  string
+		expected time.Duration
+		ok       bool
+	}{
+		{"0", "42", time.Second * 42, true},
+		{"1", "42", 0, false},
+		{"", "42", 0, false},
+		{"0", "", 0, false},
+		{"0", "0", 0, false},
+	}
+
+	for _, test := range tests {
+		var res fasthttp.Response
+		res.SetStatusCode(fasthttp.StatusOK)
+		if test.rl != "" {
+			res.Header.Set("X-Rl", test.rl)
+		}
+		if test.ttl != "" {
+			res.Header.Set("X-Ttl", test.ttl)
+		}
+
+		if d, ok := retry.Exhausted(&res); d != test.expected || ok != test.ok {
+			t.Errorf("X-Rl %q X-Ttl %q: expected %s %t got %s %t", test.rl, test.ttl, test.expected, test.ok, d, ok)
+		}
+	}
+}
@@ -3,22 +3,32 @@ package reverse
 import (
 	"context"
 	"net"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/metrics"
+	"github.com/ip-api/proxy/internal/trace"
+)
+
+var (
+	metricQueue   = metrics.NewGauge("ipapi_proxy_reverse_queue_depth", "Number of reverse lookups waiting for or being processed by a worker.")
+	metricLookups = metrics.NewCounterVec("ipapi_proxy_reverse_lookups_total", "Number of reverse lookups by result.", "result")
 )
 
 type Reverser interface {
-	Lookup(ip string, out *string, wg *sync.WaitGroup)
+	// Lookup looks up ip in the background, wg is done once out is set.
+	// The lookup is traced as a child of span.
+	Lookup(ip string, out *string, wg *sync.WaitGroup, span *trace.Span)
 }
 
 type single struct {
-	ip  string
-	out *string
-	wg  *sync.WaitGroup
+	ip   string
+	out  *string
+	wg   *sync.WaitGroup
+	span *trace.Span
 }
 
 type reverser struct {
@@ -28,25 +38,13 @@ type reverser struct {
 	queue    chan single
 }
 
-func New(logger zerolog.Logger) Reverser {
-	workers := 10
-	if v := os.Getenv("REVERSE_WORKERS"); v != "" {
-		if n, err := strconv.Atoi(v); err != nil {
-			logger.Fatal().Err(err).Msg("invalid REVERSE_WORKERS")
-		} else {
-			workers = n
-		}
-	}
-
-	preferGo := true
-	if os.Getenv("REVERSE_PREFERGO") == "false" {
-		preferGo = false
-	}
+func New(logger zerolog.Logger, cfg config.Config) Reverser {
+	workers := cfg.ReverseWorkers
 
 	r := &reverser{
 		logger: logger,
 		resolver: net.Resolver{
-			PreferGo: preferGo,
+			PreferGo: cfg.ReversePreferGo,
 		},
 		queue: make(chan single, workers*10),
 	}
@@ -65,8 +63,12 @@ func (l *reverser) worker() {
 		cancel()
 		if err != nil {
 			l.logger.Debug().Err(err).Str("ip", s.ip).Msg("failed to do reverse lookup")
+			metricLookups.With("error").Inc()
+			s.span.SetError(err)
 			*s.out = ""
 		} else {
+			metricLookups.With("success").Inc()
+
 			if len(addrs) == 0 || len(addrs[0]) == 0 {
 				*s.out = ""
 			} else {
@@ -75,15 +77,23 @@ func (l *reverser) worker() {
 			}
 		}
 
+		metricQueue.Dec()
+		s.span.End()
 		s.wg.Done()
 	}
 }
 
-func (l *reverser) Lookup(ip string, out *string, wg *sync.WaitGroup) {
+func (l *reverser) Lookup(ip string, out *string, wg *sync.WaitGroup, span *trace.Span) {
+	// The span includes the time spent waiting for a worker.
+	s := span.Child("reverse lookup", trace.KindClient)
+	s.SetAttribute("ip", ip)
+
 	wg.Add(1)
+	metricQueue.Inc()
 	l.queue <- single{
-		ip:  ip,
-		out: out,
-		wg:  wg,
+		ip:   ip,
+		out:  out,
+		wg:   wg,
+		span: s,
 	}
 }
@@ -0,0 +1,85 @@
+package special
+
+import (
+	"net"
+)
+
+// Messages ip-api.com returns for special-purpose addresses.
+const (
+	PrivateRange  = "private range"
+	ReservedRange = "reserved range"
+)
+
+type network struct {
+	net     *net.IPNet
+	message string
+}
+
+// https://www.iana.org/assignments/iana-ipv4-special-registry/iana-ipv4-special-registry.xhtml
+var ipv4 = parse(map[string]string{
+	"0.0.0.0/8":       ReservedRange, // "This network"
+	"10.0.0.0/8":      PrivateRange,
+	"100.64.0.0/10":   ReservedRange, // Shared address space (CGNAT)
+	"127.0.0.0/8":     ReservedRange, // Loopback
+	"169.254.0.0/16":  ReservedRange, // Link local
+	"172.16.0.0/12":   PrivateRange,
+	"192.0.0.0/24":    ReservedRange, // IETF protocol assignments
+	"192.0.2.0/24":    ReservedRange, // Documentation (TEST-NET-1)
+	"192.88.99.0/24":  ReservedRange, // Deprecated 6to4 relay anycast
+	"192.168.0.0/16":  PrivateRange,
+	"198.18.0.0/15":   ReservedRange, // Benchmarking
+	"198.51.100.0/24": ReservedRange, // Documentation (TEST-NET-2)
+	"203.0.113.0/24":  ReservedRange, // Documentation (TEST-NET-3)
+	"224.0.0.0/4":     ReservedRange, // Multicast
+	"240.0.0.0/4":     ReservedRange, // Reserved for future use and limited broadcast
+})
+
+// https://www.iana.org/assignments/iana-ipv6-special-registry/iana-ipv6-special-registry.xhtml
+var ipv6 = parse(map[string]string{
+	"::/128":         ReservedRange, // Unspecified
+	"::1/128":        ReservedRange, // Loopback
+	"64:ff9b:1::/48": ReservedRange, // Local-use IPv4/IPv6 translation
+	"100::/64":       ReservedRange, // Discard-only
+	"2001:2::/48":    ReservedRange, // Benchmarking
+	"2001:10::/28":   ReservedRange, // ORCHID
+	"2001:20::/28":   ReservedRange, // ORCHIDv2
+	"2001:db8::/32":  ReservedRange, // Documentation
+	"3fff::/20":      ReservedRange, // Documentation
+	"5f00::/16":      ReservedRange, // Segment routing SIDs
+	"fc00::/7":       PrivateRange,  // Unique local
+	"fe80::/10":      ReservedRange, // Link local
+	"ff00::/8":       ReservedRange, // Multicast
+})
+
+func parse(m map[string]string) []network {
+	networks := make([]network, 0, len(m))
+	for cidr, message := range m {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network{
+			net:     n,
+			message: message,
+		})
+	}
+	return networks
+}
+
+// Lookup returns the message ip-api.com responds with if ip is
+// in a private or reserved range that has no geolocation.
+func Lookup(ip net.IP) (string, bool) {
+	networks := ipv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		networks = ipv4
+	}
+
+	for _, n := range networks {
+		if n.net.Contains(ip) {
+			return n.message, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,37 @@
+package special_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ip-api/proxy/internal/special"
+)
+
+func TestLookup(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"10.0.0.1":        special.PrivateRange,
+		"172.31.255.255":  special.PrivateRange,
+		"192.168.1.1":     special.PrivateRange,
+		"::ffff:10.1.2.3": special.PrivateRange,
+		"fd00::1":         special.PrivateRange,
+		"0.0.0.0":         special.ReservedRange,
+		"127.0.0.1":       special.ReservedRange,
+		"100.64.0.1":      special.ReservedRange,
+		"169.254.169.254": special.ReservedRange,
+		"192.0.2.1":       special.ReservedRange,
+		"255.255.255.255": special.ReservedRange,
+		"::1":             special.ReservedRange,
+		"2001:db8::1":     special.ReservedRange,
+		"fe80::1":         special.ReservedRange,
+		"1.1.1.1":         "",
+		"172.32.0.1":      "",
+		"100.128.0.1":     "",
+		"2606:4700::1111": "",
+		"::ffff:8.8.8.8":  "",
+	} {
+		message, ok := special.Lookup(net.ParseIP(ip))
+		if message != expected || ok != (expected != "") {
+			t.Errorf("%s: expected %q got %q (%v)", ip, expected, message, ok)
+		}
+	}
+}
@@ -48,6 +48,94 @@ func ErrorResponse(status, message string) Response {
 	}
 }
 
+// Failed reports if the status of the response is "fail".
+func (r Response) Failed() bool {
+	return r.Status != nil && *r.Status == "fail"
+}
+
+// Merge returns r with the fields in fields taken from o.
+func (r Response) Merge(o Response, fields field.Fields) Response {
+	o = o.Trim(fields)
+	r = r.Trim(^fields)
+
+	if o.Status != nil {
+		r.Status = o.Status
+	}
+	if o.Continent != nil {
+		r.Continent = o.Continent
+	}
+	if o.ContinentCode != nil {
+		r.ContinentCode = o.ContinentCode
+	}
+	if o.Country != nil {
+		r.Country = o.Country
+	}
+	if o.CountryCode != nil {
+		r.CountryCode = o.CountryCode
+	}
+	if o.Region != nil {
+		r.Region = o.Region
+	}
+	if o.RegionName != nil {
+		r.RegionName = o.RegionName
+	}
+	if o.City != nil {
+		r.City = o.City
+	}
+	if o.District != nil {
+		r.District = o.District
+	}
+	if o.Zip != nil {
+		r.Zip = o.Zip
+	}
+	if o.Lat != nil {
+		r.Lat = o.Lat
+	}
+	if o.Lon != nil {
+		r.Lon = o.Lon
+	}
+	if o.Timezone != nil {
+		r.Timezone = o.Timezone
+	}
+	if o.Offset != nil {
+		r.Offset = o.Offset
+	}
+	if o.Currency != nil {
+		r.Currency = o.Currency
+	}
+	if o.ISP != nil {
+		r.ISP = o.ISP
+	}
+	if o.Org != nil {
+		r.Org = o.Org
+	}
+	if o.AS != nil {
+		r.AS = o.AS
+	}
+	if o.ASName != nil {
+		r.ASName = o.ASName
+	}
+	if o.Reverse != nil {
+		r.Reverse = o.Reverse
+	}
+	if o.Mobile != nil {
+		r.Mobile = o.Mobile
+	}
+	if o.Proxy != nil {
+		r.Proxy = o.Proxy
+	}
+	if o.Hosting != nil {
+		r.Hosting = o.Hosting
+	}
+	if o.Message != nil {
+		r.Message = o.Message
+	}
+	if o.Query != nil {
+		r.Query = o.Query
+	}
+	return r
+}
+
 func (r Response) Trim(fields field.Fields) Response {
 	if !fields.Contains(16384) {
 		r.Status = nil
@@ -137,15 +225,98 @@ type CacheEntry struct {
 	Fields   field.Fields `json:"fields"`
 	Expires  time.Time    `json:"-"`
 	Response Response     `json:"-"`
+	Stale    bool         `json:"-"` // Set on copies of entries that are served after they expired.
+	Source   string       `json:"-"` // Where the response came from, empty for ip-api.com.
+
+	// Expiries contains the expiry of fields that were fetched earlier and expire before Expires.
+	// All other fields expire at Expires.
+	Expiries []FieldsExpiry `json:"-"`
+}
+
+// SourceMMDB is the Source of entries served from a local MMDB database.
+const SourceMMDB = "mmdb"
+
+// FieldsExpiry is the expiry of a set of fields of a CacheEntry.
+type FieldsExpiry struct {
+	Fields  field.Fields `json:"fields"`
+	Expires time.Time    `json:"expires"`
+}
+
+// FreshFields returns the fields of the entry which haven't expired at t.
+func (c *CacheEntry) FreshFields(t time.Time) field.Fields {
+	if !c.Expires.After(t) {
+		return 0
+	}
+
+	fields := c.Fields
+	for _, e := range c.Expiries {
+		if !e.Expires.After(t) {
+			fields = fields.Remove(e.Fields)
+		}
+	}
+	return fields
+}
+
+// MergeOlder adds the fields of older, which is an earlier response for the same query,
+// that are still fresh at now and weren't fetched again.
+// Failed responses aren't merged as they don't contain any fields.
+func (c *CacheEntry) MergeOlder(older *CacheEntry, now time.Time) {
+	if c.Response.Failed() || older.Response.Failed() {
+		return
+	}
+
+	keep := older.FreshFields(now).Remove(c.Fields)
+	if keep == 0 {
+		return
+	}
+
+	c.Response = c.Response.Merge(older.Response, keep)
+	c.Fields = c.Fields.Merge(keep)
+
+	// Fields of older that aren't in any of its Expiries expire at older.Expires.
+	rest := keep
+	for _, e := range older.Expiries {
+		if f := e.Fields & keep; f != 0 {
+			c.addExpiry(f, e.Expires)
+			rest = rest.Remove(f)
+		}
+	}
+	if rest != 0 {
+		c.addExpiry(rest, older.Expires)
+	}
 }
 
-var emptyCacheEntrySize = int(unsafe.Sizeof(CacheEntry{}))
+func (c *CacheEntry) addExpiry(fields field.Fields, expires time.Time) {
+	if !expires.Before(c.Expires) {
+		// The fields expire together with the rest of the entry.
+		return
+	}
+
+	for i := range c.Expiries {
+		if c.Expiries[i].Expires.Equal(expires) {
+			c.Expiries[i].Fields = c.Expiries[i].Fields.Merge(fields)
+			return
+		}
+	}
+
+	c.Expiries = append(c.Expiries, FieldsExpiry{
+		Fields:  fields,
+		Expires: expires,
+	})
+}
+
+var (
+	emptyCacheEntrySize = int(unsafe.Sizeof(CacheEntry{}))
+	fieldsExpirySize    = int(unsafe.Sizeof(FieldsExpiry{}))
+)
 
 // Size returns the size of the CacheEntry in bytes.
 func (c *CacheEntry) Size() int {
 	size := emptyCacheEntrySize +
 		len(c.IP) +
-		len(c.Lang)
+		len(c.Lang) +
+		len(c.Source) +
+		len(c.Expiries)*fieldsExpirySize
 
 	if c.Response.Status != nil {
 		size += len(*c.Response.Status)
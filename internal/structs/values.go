@@ -0,0 +1,63 @@
+package structs
+
+// Value is a single field of a Response.
+// Value is either a string, float64, int or bool.
+type Value struct {
+	Name  string
+	Value interface{}
+}
+
+// Values returns all fields which are set in the order ip-api.com uses
+// for its non JSON formats.
+func (r Response) Values() []Value {
+	values := make([]Value, 0, 25)
+
+	str := func(name string, v *string) {
+		if v != nil {
+			values = append(values, Value{name, *v})
+		}
+	}
+	flt := func(name string, v *float64) {
+		if v != nil {
+			values = append(values, Value{name, *v})
+		}
+	}
+	integer := func(name string, v *int) {
+		if v != nil {
+			values = append(values, Value{name, *v})
+		}
+	}
+	boolean := func(name string, v *bool) {
+		if v != nil {
+			values = append(values, Value{name, *v})
+		}
+	}
+
+	str("status", r.Status)
+	str("message", r.Message)
+	str("continent", r.Continent)
+	str("continentCode", r.ContinentCode)
+	str("country", r.Country)
+	str("countryCode", r.CountryCode)
+	str("region", r.Region)
+	str("regionName", r.RegionName)
+	str("city", r.City)
+	str("district", r.District)
+	str("zip", r.Zip)
+	flt("lat", r.Lat)
+	flt("lon", r.Lon)
+	str("timezone", r.Timezone)
+	integer("offset", r.Offset)
+	str("currency", r.Currency)
+	str("isp", r.ISP)
+	str("org", r.Org)
+	str("as", r.AS)
+	str("asname", r.ASName)
+	str("reverse", r.Reverse)
+	boolean("mobile", r.Mobile)
+	boolean("proxy", r.Proxy)
+	boolean("hosting", r.Hosting)
+	str("query", r.Query)
+
+	return values
+}
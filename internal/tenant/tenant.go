@@ -0,0 +1,148 @@
+// Package tenant authenticates clients of the proxy using keys from a tenants file.
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/ip-api/proxy/internal/field"
+)
+
+// Fields that are always allowed as error responses need them.
+var alwaysAllowed = field.FromCSV("status,message")
+
+// Tenant is a client of the proxy.
+type Tenant struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Enabled bool   `json:"enabled"`
+
+	// Fields is the mask of allowed fields, a number or a comma separated list
+	// like the fields parameter. All fields are allowed if it is empty.
+	Fields fieldMask `json:"fields"`
+
+	// Languages are the allowed languages. All languages are allowed if it is empty.
+	Languages []string `json:"languages"`
+}
+
+type fieldMask struct {
+	set    bool
+	fields field.Fields
+}
+
+func (m *fieldMask) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+	case float64:
+		m.set, m.fields = true, field.FromInt(int(v))
+	case string:
+		if v == "" {
+			break
+		}
+		if n, err := strconv.Atoi(v); err == nil {
+			m.set, m.fields = true, field.FromInt(n)
+		} else {
+			m.set, m.fields = true, field.FromCSV(v)
+		}
+	default:
+		return fmt.Errorf("invalid fields %s", b)
+	}
+
+	return nil
+}
+
+// Strip removes the fields the tenant isn't allowed to request from fields.
+func (t *Tenant) Strip(fields field.Fields) field.Fields {
+	if t == nil || !t.Fields.set {
+		return fields
+	}
+	return fields.Remove(^t.Fields.fields.Merge(alwaysAllowed))
+}
+
+// AllowsLanguage returns true if the tenant can request responses in lang.
+func (t *Tenant) AllowsLanguage(lang string) bool {
+	if t == nil || len(t.Languages) == 0 {
+		return true
+	}
+	for _, l := range t.Languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// Tenants holds the tenants by key. It is safe for concurrent use.
+type Tenants struct {
+	mu    sync.RWMutex
+	byKey map[string]*Tenant
+}
+
+// Load returns the tenants in the JSON file at path, a list of Tenant objects:
+//
+//	[{"name": "search", "key": "secret", "enabled": true, "fields": "country,city", "languages": ["en", "de"]}]
+func Load(path string) (*Tenants, error) {
+	t := &Tenants{}
+	if err := t.Reload(path); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload replaces the tenants with the ones in the file at path.
+// The current tenants are kept if the file is invalid.
+func (t *Tenants) Reload(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var list []*Tenant
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	byKey := make(map[string]*Tenant, len(list))
+	for _, tenant := range list {
+		if tenant.Name == "" {
+			return fmt.Errorf("%s: tenant without a name", path)
+		}
+		if tenant.Key == "" {
+			return fmt.Errorf("%s: tenant %q has no key", path, tenant.Name)
+		}
+		if _, ok := byKey[tenant.Key]; ok {
+			return fmt.Errorf("%s: tenant %q has the key of another tenant", path, tenant.Name)
+		}
+		byKey[tenant.Key] = tenant
+	}
+
+	t.mu.Lock()
+	t.byKey = byKey
+	t.mu.Unlock()
+
+	return nil
+}
+
+// ErrInvalidKey is returned for keys that are unknown or belong to a disabled tenant.
+var ErrInvalidKey = errors.New("invalid/expired key")
+
+// Authenticate returns the enabled tenant with key.
+func (t *Tenants) Authenticate(key string) (*Tenant, error) {
+	t.mu.RLock()
+	tenant, ok := t.byKey[key]
+	t.mu.RUnlock()
+
+	if !ok || key == "" || !tenant.Enabled {
+		return nil, ErrInvalidKey
+	}
+	return tenant, nil
+}
@@ -0,0 +1,98 @@
+package tenant_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ip-api/proxy/internal/field"
+	"github.com/ip-api/proxy/internal/tenant"
+)
+
+func writeTenants(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticate(t *testing.T) {
+	tenants, err := tenant.Load(writeTenants(t, `[
+		{"name": "search", "key": "a", "enabled": true, "fields": "country,city", "languages": ["en", "de"]},
+		{"name": "ads", "key": "b", "enabled": true, "fields": 17},
+		{"name": "old", "key": "c", "enabled": false}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "c", "d"} {
+		if _, err := tenants.Authenticate(key); err != tenant.ErrInvalidKey {
+			t.Errorf("%q: expected %v got %v", key, tenant.ErrInvalidKey, err)
+		}
+	}
+
+	search, err := tenants.Authenticate("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if search.Name != "search" {
+		t.Errorf("expected search got %q", search.Name)
+	}
+	if fields := search.Strip(field.Default); fields != field.FromCSV("status,message,country,city") {
+		t.Errorf("expected status,message,country,city got %s", fields)
+	}
+	if !search.AllowsLanguage("de") || search.AllowsLanguage("fr") {
+		t.Errorf("expected only en and de to be allowed")
+	}
+
+	ads, err := tenants.Authenticate("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := ads.Strip(field.FromCSV("country,city,isp")); fields != field.FromCSV("country,city") {
+		t.Errorf("expected country,city got %s", fields)
+	}
+	if !ads.AllowsLanguage("fr") {
+		t.Errorf("expected all languages to be allowed")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeTenants(t, `[{"name": "search", "key": "a", "enabled": true}]`)
+
+	tenants, err := tenant.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`[{"name": "search", "key": "a"}, {"name": "ads", "key": "a"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.Reload(path); err == nil {
+		t.Fatal("expected an error for a duplicate key")
+	}
+	if _, err := tenants.Authenticate("a"); err != nil {
+		t.Errorf("expected the current tenants to be kept got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`[{"name": "search", "key": "a"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenants.Authenticate("a"); err != tenant.ErrInvalidKey {
+		t.Errorf("expected the disabled tenant to be rejected got %v", err)
+	}
+}
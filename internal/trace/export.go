@@ -0,0 +1,310 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/metrics"
+)
+
+const (
+	maxQueuedSpans = 4096
+	maxExportSpans = 512
+	exportInterval = time.Second * 5
+)
+
+var (
+	metricExported = metrics.NewCounterVec("ipapi_proxy_trace_spans_total", "Number of spans by export result.", "result")
+)
+
+// New returns a Tracer which exports spans in the OTLP/HTTP JSON format to
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT + "/v1/traces".
+// If neither is set New returns a nil Tracer, which disables tracing.
+// See: https://opentelemetry.io/docs/specs/otel/protocol/exporter/
+func New(logger zerolog.Logger, cfg config.Config) *Tracer {
+	url := cfg.OtelTracesEndpoint
+	if url == "" && cfg.OtelEndpoint != "" {
+		url = strings.TrimSuffix(cfg.OtelEndpoint, "/") + "/v1/traces"
+	}
+	if url == "" {
+		return nil
+	}
+
+	// Validated by the config.
+	headers := make(map[string]string)
+	for _, h := range cfg.OtelHeaders {
+		kv := strings.SplitN(h, "=", 2)
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	e := &exporter{
+		logger:  logger,
+		url:     url,
+		headers: headers,
+		service: cfg.OtelServiceName,
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
+		spans: make(chan *Span, maxQueuedSpans),
+		flush: make(chan flushRequest),
+	}
+
+	go e.loop()
+
+	return &Tracer{
+		exporter: e,
+		ratio:    cfg.OtelSamplerArg,
+	}
+}
+
+type exporter struct {
+	logger zerolog.Logger
+
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+
+	spans chan *Span
+	flush chan flushRequest
+}
+
+// flushRequest asks the exporter to export everything that is queued before ctx is done.
+type flushRequest struct {
+	ctx  context.Context
+	done chan struct{}
+}
+
+// queue adds a span to be exported. Spans are dropped if the exporter can't keep up.
+func (e *exporter) queue(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+		metricExported.With("dropped").Inc()
+	}
+}
+
+func (e *exporter) loop() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	spans := make([]*Span, 0, maxExportSpans)
+
+	for {
+		ctx := context.Background()
+		var done chan struct{}
+
+		select {
+		case s := <-e.spans:
+			spans = append(spans, s)
+			if len(spans) < maxExportSpans {
+				continue
+			}
+		case <-ticker.C:
+		case f := <-e.flush:
+			ctx, done = f.ctx, f.done
+
+			// Export everything that is queued.
+			for len(e.spans) > 0 && len(spans) < maxQueuedSpans {
+				spans = append(spans, <-e.spans)
+			}
+		}
+
+		if len(spans) > 0 {
+			if err := e.export(ctx, spans); err != nil {
+				e.logger.Error().Err(err).Int("spans", len(spans)).Msg("failed to export spans")
+				metricExported.With("error").Add(int64(len(spans)))
+			} else {
+				metricExported.With("success").Add(int64(len(spans)))
+			}
+
+			spans = spans[:0]
+		}
+
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+func (e *exporter) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest.
+// See: https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR.
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is encoded as a string.
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *exporter) request(spans []*Span) otlpRequest {
+	service := e.service
+
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{
+					Key:   "service.name",
+					Value: otlpValue{StringValue: &service},
+				}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/ip-api/proxy"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+
+	for _, a := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpAttribute{
+			Key:   a.key,
+			Value: otlpAttributeValue(a.value),
+		})
+	}
+
+	for _, l := range s.links {
+		o.Links = append(o.Links, otlpLink{
+			TraceID: hex.EncodeToString(l.TraceID[:]),
+			SpanID:  hex.EncodeToString(l.SpanID[:]),
+		})
+	}
+
+	if s.isError {
+		o.Status = &otlpStatus{
+			Code:    2,
+			Message: s.err,
+		}
+	}
+
+	return o
+}
+
+func otlpAttributeValue(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		i := strconv.Itoa(v)
+		return otlpValue{IntValue: &i}
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &i}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	}
+
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
@@ -0,0 +1,284 @@
+// Package trace records spans compatible with OpenTelemetry and exports them over OTLP.
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// Kind is the OpenTelemetry span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports if sc has a trace and span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent returns sc in the W3C traceparent header format.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header.
+// See: https://www.w3.org/TR/trace-context/#traceparent-header
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly 4 parts, future versions may append more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is a single operation within a trace.
+// All methods can be called on a nil Span, which is what is used when tracing is disabled.
+type Span struct {
+	tracer *Tracer
+
+	mu      sync.Mutex
+	ctx     SpanContext
+	parent  SpanID
+	name    string
+	kind    Kind
+	start   time.Time
+	end     time.Time
+	attrs   []attribute
+	links   []SpanContext
+	err     string
+	isError bool
+}
+
+// Context returns the SpanContext of s, which is invalid for a nil Span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ctx
+}
+
+// Sampled reports if s will be exported.
+func (s *Span) Sampled() bool {
+	return s.Context().Sampled
+}
+
+// SetSampled makes sure s is exported.
+// This is used for spans without a parent that serve sampled spans.
+func (s *Span) SetSampled() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.ctx.Sampled = true
+	s.mu.Unlock()
+}
+
+// Child starts a new span with s as parent.
+func (s *Span) Child(name string, kind Kind) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.Start(name, s.Context(), kind)
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute sets an attribute, value has to be a string, bool, int, int64 or float64.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// AddLink links s to a span in another trace, for example the batch that served a request.
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+
+	s.mu.Lock()
+	s.links = append(s.links, sc)
+	s.mu.Unlock()
+}
+
+// SetError marks s as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.isError = true
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End ends s and queues it for exporting if it is sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.end = time.Now()
+	sampled := s.ctx.Sampled
+	s.mu.Unlock()
+
+	if sampled {
+		s.tracer.export(s)
+	}
+}
+
+// Tracer starts spans and exports them.
+// A nil Tracer disables tracing.
+type Tracer struct {
+	exporter *exporter
+	ratio    float64
+}
+
+// Default is the Tracer used by Start. It is nil, and thus tracing is disabled, unless set.
+var Default *Tracer
+
+// Start starts a span with the Default Tracer.
+func Start(name string, parent SpanContext, kind Kind) *Span {
+	return Default.Start(name, parent, kind)
+}
+
+// Start starts a span. If parent isn't valid the span is the root of a new trace,
+// which is sampled according to OTEL_TRACES_SAMPLER_ARG. Otherwise the sampling decision of the parent is used.
+func (t *Tracer) Start(name string, parent SpanContext, kind Kind) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		randomBytes(s.ctx.TraceID[:])
+		s.ctx.Sampled = t.ratio >= 1 || rand.Float64() < t.ratio
+	}
+	randomBytes(s.ctx.SpanID[:])
+
+	return s
+}
+
+// Flush exports all ended spans. It gives up at deadline and returns false
+// if the spans couldn't be exported by then.
+func (t *Tracer) Flush(deadline time.Time) bool {
+	if t == nil || t.exporter == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// The exporter can be busy exporting spans on its own.
+	done := make(chan struct{})
+	select {
+	case t.exporter.flush <- flushRequest{ctx: ctx, done: done}:
+	case <-ctx.Done():
+		return false
+	}
+
+	<-done
+	return ctx.Err() == nil
+}
+
+func (t *Tracer) export(s *Span) {
+	if t.exporter != nil {
+		t.exporter.queue(s)
+	}
+}
+
+func randomBytes(b []byte) {
+	for i := 0; i < len(b); i += 8 {
+		r := rand.Uint64()
+		for j := i; j < i+8 && j < len(b); j++ {
+			b[j] = byte(r)
+			r >>= 8
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package trace_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/ip-api/proxy/internal/config"
+	"github.com/ip-api/proxy/internal/trace"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		sc, ok := trace.ParseTraceparent(test.header)
+		if ok != test.valid {
+			t.Errorf("%q: expected valid %v got %v", test.header, test.valid, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if sc.Sampled != test.sampled {
+			t.Errorf("%q: expected sampled %v got %v", test.header, test.sampled, sc.Sampled)
+		}
+		if test.header[:2] == "00" && sc.Traceparent() != test.header {
+			t.Errorf("expected %q got %q", test.header, sc.Traceparent())
+		}
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	var tracer *trace.Tracer
+
+	span := tracer.Start("test", trace.SpanContext{}, trace.KindServer)
+	if span != nil {
+		t.Fatalf("expected nil span got %v", span)
+	}
+
+	// None of these should panic.
+	child := span.Child("child", trace.KindInternal)
+	child.SetAttribute("a", 1)
+	child.SetError(errors.New("test"))
+	child.AddLink(span.Context())
+	child.End()
+	span.End()
+	tracer.Flush(time.Now().Add(time.Second))
+}
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Links []struct {
+		TraceID string `json:"traceId"`
+		SpanID  string `json:"spanId"`
+	} `json:"links"`
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+	}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.OtelEndpoint = server.URL
+	cfg.OtelHeaders = []string{"Authorization=secret"}
+
+	tracer := trace.New(zerolog.Nop(), cfg)
+
+	parent, _ := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	unsampled, _ := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	root := tracer.Start("root", parent, trace.KindServer)
+	root.SetAttribute("http.status_code", 200)
+	child := root.Child("child", trace.KindClient)
+	child.SetError(errors.New("failed"))
+	child.AddLink(parent)
+	child.End()
+	root.End()
+
+	// Not exported.
+	tracer.Start("unsampled", unsampled, trace.KindServer).End()
+
+	if !tracer.Flush(time.Now().Add(time.Second * 5)) {
+		t.Fatal("expected the spans to be exported")
+	}
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []exportedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(<-requests, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans got %d", len(spans))
+	}
+
+	c, r := spans[0], spans[1]
+	if r.Name != "root" || r.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || r.ParentSpanID != "00f067aa0ba902b7" || r.Kind != 2 {
+		t.Errorf("unexpected root span %+v", r)
+	}
+	if len(r.Attributes) != 1 || r.Attributes[0].Key != "http.status_code" || r.Attributes[0].Value["intValue"] != "200" {
+		t.Errorf("unexpected root attributes %+v", r.Attributes)
+	}
+	if c.Name != "child" || c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || c.Kind != 3 {
+		t.Errorf("unexpected child span %+v", c)
+	}
+	if c.Status == nil || c.Status.Code != 2 || c.Status.Message != "failed" {
+		t.Errorf("unexpected child status %+v", c.Status)
+	}
+	if len(c.Links) != 1 || c.Links[0].SpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected child links %+v", c.Links)
+	}
+}
+
+func TestFlushDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cfg := config.Default()
+	cfg.OtelEndpoint = server.URL
+
+	tracer := trace.New(zerolog.Nop(), cfg)
+
+	tracer.Start("root", trace.SpanContext{}, trace.KindServer).End()
+
+	start := time.Now()
+	if tracer.Flush(start.Add(time.Millisecond * 100)) {
+		t.Error("expected the flush to give up")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected the flush to give up at the deadline, took %v", took)
+	}
+}